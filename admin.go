@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	rus "github.com/sirupsen/logrus"
+	"time"
+)
+
+// chunkSize is the size of the archive chunks sent by Export.
+const chunkSize = 64 << 10
+
+// authorizeAdmin returns an error unless idt is one of the admin users.
+func (s *server) authorizeAdmin(idt *lib.Identity) error {
+	if !s.getRuntime().adminUsers[idt.Pid] {
+		return permissionDenied
+	}
+	return nil
+}
+
+func (s *server) Export(req *pb.ExportReq, stream pb.Admin_ExportServer) error {
+
+	ctx := stream.Context()
+	traceID, err := getGRPCTraceID(ctx)
+	if err != nil {
+		rus.Error(err)
+		return toGRPCError(ctx, err, "")
+	}
+	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
+	ctx = newGRPCTraceContext(ctx, traceID)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "export",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, _, err := s.authenticate(ctx, &req.AccessToken)
+	if err != nil {
+		log.Error(err)
+		return unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	if err := s.authorizeAdmin(idt); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	release, err := s.limit(ctx, "export", idt)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer release()
+
+	ctx, cancel := s.withTimeout(ctx, "export")
+	defer cancel()
+
+	w := bufio.NewWriterSize(&chunkWriter{stream: stream}, chunkSize)
+	n, err := s.exportRecords(ctx, req.Path, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Error(err)
+		return toGRPCError(ctx, err, req.Path)
+	}
+
+	log.Infof("exported %d records under %s", n, req.Path)
+
+	return nil
+}
+
+func (s *server) Import(stream pb.Admin_ImportServer) error {
+
+	ctx := stream.Context()
+	traceID, err := getGRPCTraceID(ctx)
+	if err != nil {
+		rus.Error(err)
+		return toGRPCError(ctx, err, "")
+	}
+	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
+	ctx = newGRPCTraceContext(ctx, traceID)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
+
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "import",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	// the options and the token come in the first message
+	req, err := stream.Recv()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	idt, _, err := s.authenticate(ctx, &req.AccessToken)
+	if err != nil {
+		log.Error(err)
+		return unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	// reads of the caller go to the primary for a while
+	defer s.replicas.wrote(idt.Pid)
+
+	if err := s.authorizeAdmin(idt); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	release, err := s.limit(ctx, "import", idt)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer release()
+
+	ctx, cancel := s.withTimeout(ctx, "import")
+	defer cancel()
+
+	opts := &importOptions{}
+	opts.root = req.Root
+	opts.preserveIDs = req.PreserveIds
+	opts.replace = req.Replace
+
+	n, err := s.importRecords(ctx, &chunkReader{stream: stream, data: req.Data}, opts)
+	if err != nil {
+		log.Error(err)
+		return toGRPCError(ctx, err, req.Root)
+	}
+
+	log.Infof("imported %d records", n)
+
+	return stream.SendAndClose(&pb.ImportRes{Imported: uint64(n)})
+}
+
+// chunkWriter sends what is written to it as Export chunks.
+type chunkWriter struct {
+	stream pb.Admin_ExportServer
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	if err := w.stream.Send(&pb.Chunk{Data: data}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// chunkReader reads the data of the Import messages.
+type chunkReader struct {
+	stream pb.Admin_ImportServer
+	data   []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			// io.EOF once the client closes its side
+			return 0, err
+		}
+		r.data = req.Data
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/nu7hatch/gouuid"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// archiveFormat identifies the archives made by export.
+	archiveFormat = "clawio-prop"
+
+	// archiveVersion is the version of the archives written. Archives
+	// of newer versions are rejected, older ones must stay readable.
+	archiveVersion = 1
+
+	// importBatchSize is the number of records inserted per statement.
+	importBatchSize = 500
+)
+
+// archiveHeader is the first line of an archive.
+type archiveHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	// Root is the path the records were exported from.
+	Root    string `json:"root"`
+	Created int64  `json:"created"`
+}
+
+// archiveRecord is every other line of an archive. Path is relative
+// to the root of the archive, empty for the root itself, so records
+// can be imported under another path.
+type archiveRecord struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	Checksum string `json:"checksum,omitempty"`
+	ETag     string `json:"etag"`
+	MTime    uint32 `json:"mtime"`
+}
+
+// importOptions select how the records of an archive are imported.
+type importOptions struct {
+	// root is the path the records are imported under,
+	// the root of the archive if empty.
+	root string
+
+	// preserveIDs keeps the IDs of the archive. Imports fail if any of
+	// them is already in use, which is always the case when importing
+	// back into the same database under another root.
+	preserveIDs bool
+
+	// replace removes the records under root before importing.
+	// Otherwise imports fail if there are any.
+	replace bool
+}
+
+// exportRecords writes the record of root and all the records under it
+// to w as an NDJSON archive: a header line followed by a line per
+// record, parents before their children. Records are written as they
+// are read. It returns the number of records written.
+func (s *server) exportRecords(ctx context.Context, root string, w io.Writer) (int, error) {
+
+	root, err := s.paths.canonical(root)
+	if err != nil {
+		return 0, err
+	}
+	root, err = s.resolvePath(ctx, root)
+	if err != nil {
+		return 0, err
+	}
+
+	enc := json.NewEncoder(w)
+	n := 0
+	write := func(r *record) error {
+		// the header is only written once there is something to export
+		if n == 0 {
+			header := &archiveHeader{}
+			header.Format = archiveFormat
+			header.Version = archiveVersion
+			header.Root = root
+			header.Created = time.Now().Unix()
+			if err := enc.Encode(header); err != nil {
+				return err
+			}
+		}
+
+		ar := &archiveRecord{}
+		ar.ID = r.ID
+		ar.Path = strings.TrimPrefix(strings.TrimPrefix(r.Path, root), "/")
+		ar.Checksum = r.Checksum
+		ar.ETag = r.ETag
+		ar.MTime = r.MTime
+		if err := enc.Encode(ar); err != nil {
+			return err
+		}
+		n++
+		return nil
+	}
+
+	rec, err := s.getByPath(ctx, root)
+	if err != nil && err != gorm.RecordNotFound {
+		return 0, err
+	}
+	if err == nil {
+		if err := write(rec); err != nil {
+			return n, err
+		}
+	}
+	if err := s.eachDescendant(ctx, root, write); err != nil {
+		return n, err
+	}
+	if n == 0 {
+		return 0, gorm.RecordNotFound
+	}
+	return n, nil
+}
+
+// importRecords reads an archive written by exportRecords and inserts
+// its records under opts.root, in batches as they are read but in a
+// single transaction, then propagates the change to the ancestors of
+// the root. It returns the number of records imported.
+func (s *server) importRecords(ctx context.Context, r io.Reader, opts *importOptions) (int, error) {
+
+	traceID, err := getGRPCTraceID(ctx)
+	if err != nil {
+		return 0, err
+	}
+	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
+	ctx = newGRPCTraceContext(ctx, traceID)
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	header := &archiveHeader{}
+	if err := dec.Decode(header); err != nil {
+		return 0, newGRPCError(ctx, codes.InvalidArgument, reasonInvalidArchive, "", "invalid archive header: %s", err)
+	}
+	if header.Format != archiveFormat {
+		return 0, newGRPCError(ctx, codes.InvalidArgument, reasonInvalidArchive, "", "not an archive of records: format %q", header.Format)
+	}
+	if header.Version < 1 || header.Version > archiveVersion {
+		return 0, newGRPCError(ctx, codes.InvalidArgument, reasonInvalidArchive, "",
+			"archive version %d not supported, the newest is %d", header.Version, archiveVersion)
+	}
+
+	root := opts.root
+	if root == "" {
+		root = header.Root
+	}
+	root, err = s.paths.canonical(root)
+	if err != nil {
+		return 0, err
+	}
+	// in a case insensitive namespace keep the case already stored
+	root, err = s.resolvePath(ctx, root)
+	if err != nil {
+		return 0, err
+	}
+	if strings.Count(root, "/") < s.getRuntime().homeDepth {
+		return 0, newGRPCError(ctx, codes.InvalidArgument, reasonInvalidPath, root, "cannot import above a home directory")
+	}
+	if rec, err := s.caseCollision(ctx, root, ""); err != nil {
+		return 0, err
+	} else if rec != nil {
+		return 0, newGRPCError(ctx, codes.AlreadyExists, reasonCaseCollision, rec.Path, "path collides in case with an existing one")
+	}
+
+	ar := &archiveReader{s: s, dec: dec, root: root, preserveIDs: opts.preserveIDs, line: 1}
+	var imported int
+	if s.tree {
+		imported, err = s.treeImport(ctx, ar, opts.replace, log)
+	} else {
+		imported, err = s.pathImport(ctx, ar, opts.replace, log)
+	}
+	s.records.purge()
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("%d records from archive of %s imported under %s", imported, header.Root, root)
+
+	etag, err := uuid.NewV4()
+	if err != nil {
+		return 0, err
+	}
+	// the records imported keep their own mtimes, the ancestors of
+	// the root get the current time for the change to propagate
+	if err := s.propagateChanges(ctx, root, etag.String(), uint32(time.Now().Unix()), ""); err != nil {
+		return 0, err
+	}
+	return imported, nil
+}
+
+// archiveReader reads the records of an archive after its header.
+type archiveReader struct {
+	s           *server
+	dec         *json.Decoder
+	root        string
+	preserveIDs bool
+	line        int
+}
+
+// next returns the next record of the archive under the root,
+// with a new ID unless IDs are preserved, or io.EOF at the end.
+func (ar *archiveReader) next(ctx context.Context) (*record, error) {
+
+	ar.line++
+	a := &archiveRecord{}
+	err := ar.dec.Decode(a)
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		return nil, newGRPCError(ctx, codes.InvalidArgument, reasonInvalidArchive, "", "invalid record at line %d: %s", ar.line, err)
+	}
+
+	p, err := ar.s.paths.canonical(path.Join(ar.root, a.Path))
+	if err != nil {
+		return nil, err
+	}
+	// relative paths must not escape the root
+	if p != ar.root && !isAncestor(ar.root, p) {
+		return nil, newGRPCError(ctx, codes.InvalidArgument, reasonInvalidArchive, "", "record at line %d is not under the root", ar.line)
+	}
+
+	rec := &record{}
+	rec.ID = a.ID
+	rec.Path = p
+	rec.FoldPath = ar.s.paths.fold(p)
+	rec.Checksum = a.Checksum
+	rec.ETag = a.ETag
+	rec.MTime = a.MTime
+	if !ar.preserveIDs || rec.ID == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return nil, err
+		}
+		rec.ID = id.String()
+	}
+	return rec, nil
+}
+
+// duplicateError maps a duplicate key error of an insert of imported
+// records, the archive repeats a path or an id, to INVALID_ARCHIVE.
+func duplicateError(ctx context.Context, err error) error {
+	if e, ok := err.(*mysql.MySQLError); ok && e.Number == mysqlErrDupEntry {
+		return newGRPCError(ctx, codes.InvalidArgument, reasonInvalidArchive, "", "duplicate record in the archive: %s", e.Message)
+	}
+	return err
+}
+
+// idInUse returns an error if any of ids is used by a row of table.
+func idInUse(ctx context.Context, tx *sql.Tx, table string, ids []interface{}) error {
+	var id string
+	err := tx.QueryRowContext(ctx, "SELECT id FROM "+table+" WHERE id IN ("+placeholders(len(ids))+") LIMIT 1", ids...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return newGRPCError(ctx, codes.AlreadyExists, reasonAlreadyExists, "", "id %s is already in use, import without preserving ids", id)
+}
+
+// pathImport is the part of importRecords storing the records
+// in the path layout.
+func (s *server) pathImport(ctx context.Context, ar *archiveReader, replace bool, log *rus.Entry) (int, error) {
+
+	root := ar.root
+	tx, err := s.db.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	where, args := "path=? OR path LIKE ? ESCAPE '"+likeEscape+"'", []interface{}{root, likePrefix(root + "/")}
+	if s.paths.caseInsensitive {
+		where, args = "fold_path=? OR fold_path LIKE ? ESCAPE '"+likeEscape+"'", []interface{}{s.paths.fold(root), likePrefix(s.paths.fold(root + "/"))}
+	}
+	existing, err := queryRecords(ctx, tx, where+" LIMIT 1", args...)
+	if err != nil {
+		return 0, err
+	}
+	if len(existing) > 0 {
+		if !replace {
+			return 0, newGRPCError(ctx, codes.AlreadyExists, reasonAlreadyExists, root, "there are records under the root, import with replace")
+		}
+		res, err := tx.ExecContext(ctx, "DELETE FROM records WHERE "+where, args...)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		log.Infof("%d records under %s replaced", n, root)
+	}
+
+	// records are inserted in batches as they are read, the
+	// transaction keeps the import all or nothing
+	imported := 0
+	batch := []*record{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		ids := []interface{}{}
+		values := []interface{}{}
+		for _, rec := range batch {
+			ids = append(ids, rec.ID)
+			values = append(values, rec.ID, rec.Path, rec.FoldPath, rec.Checksum, rec.ETag, rec.MTime)
+		}
+		if ar.preserveIDs {
+			if err := idInUse(ctx, tx, "records", ids); err != nil {
+				return err
+			}
+		}
+
+		rows := strings.TrimSuffix(strings.Repeat("(?,?,?,?,?,?),", len(batch)), ",")
+		_, err := tx.ExecContext(ctx, "INSERT INTO records (id,path,fold_path,checksum,e_tag,m_time) VALUES "+rows, values...)
+		if err != nil {
+			// the records under the root are gone, the archive repeats a path or an id
+			return duplicateError(ctx, err)
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		rec, err := ar.next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		batch = append(batch, rec)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	return imported, tx.Commit()
+}
+
+// treeImport is the part of importRecords storing the records in the
+// tree layout. The IDs of the nodes imported are cached by path to
+// find the parents of the records that follow. Parents missing from
+// the archive, or no longer cached, are looked up in the transaction
+// and created as placeholders if missing, so archives must list the
+// parents before their children, as exportRecords does.
+func (s *server) treeImport(ctx context.Context, ar *archiveReader, replace bool, log *rus.Entry) (int, error) {
+
+	root := ar.root
+	if root == "/" {
+		return 0, &pathError{root, "the root cannot have a record in the tree layout"}
+	}
+
+	// the ancestors of the root are created outside
+	// the transaction, as they are for Put
+	parents, err := s.treeWalk(ctx, path.Dir(root), true)
+	if err != nil {
+		return 0, err
+	}
+	rootParent := treeRef{id: "", path: "/"}
+	if len(parents) > 0 {
+		rootParent = parents[len(parents)-1]
+	}
+
+	tx, err := s.db.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// lookup finds the child name of parentID in the transaction
+	where := "parent_id=? AND fold_name=?"
+	lookup := func(parentID, name string) (*node, error) {
+		n := &node{}
+		err := scanNode(tx.QueryRowContext(ctx, "SELECT "+nodeColumns+" FROM nodes WHERE "+where, parentID, s.pathKey(name)), n)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return n, err
+	}
+
+	rootNode, err := lookup(rootParent.id, path.Base(root))
+	if err != nil {
+		return 0, err
+	}
+	if rootNode != nil {
+		ids := []interface{}{rootNode.id}
+		err := visitNodes(ctx, tx, treeRef{id: rootNode.id, path: root}, func(n *node, p string) error {
+			ids = append(ids, n.id)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		// an empty placeholder for the root is replaced silently
+		if (len(ids) > 1 || !rootNode.placeholder) && !replace {
+			return 0, newGRPCError(ctx, codes.AlreadyExists, reasonAlreadyExists, root, "there are records under the root, import with replace")
+		}
+		if err := deleteNodes(ctx, tx, ids, 0); err != nil {
+			return 0, err
+		}
+		log.Infof("%d nodes under %s replaced", len(ids), root)
+	}
+
+	// nodes are inserted in batches as they are read, the
+	// transaction keeps the import all or nothing
+	imported := 0
+	batch := [][]interface{}{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		ids := []interface{}{}
+		values := []interface{}{}
+		for _, row := range batch {
+			ids = append(ids, row[0])
+			values = append(values, row...)
+		}
+		if ar.preserveIDs {
+			if err := idInUse(ctx, tx, "nodes", ids); err != nil {
+				return err
+			}
+		}
+
+		rows := strings.TrimSuffix(strings.Repeat("(?,?,?,?,?,?,?,0),", len(batch)), ",")
+		_, err := tx.ExecContext(ctx, `INSERT INTO nodes (id, parent_id, name, fold_name, checksum, e_tag, m_time, placeholder)
+		VALUES `+rows, values...)
+		if err != nil {
+			return duplicateError(ctx, err)
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	cache := newLRU(treeCacheSize)
+	var parentID func(p string) (string, error)
+	parentID = func(p string) (string, error) {
+		dir := path.Dir(p)
+		if p == root {
+			return rootParent.id, nil
+		}
+		if id, ok := cache.get(s.pathKey(dir)); ok {
+			return id.(string), nil
+		}
+
+		// the nodes batched must be visible to the lookup
+		if err := flush(); err != nil {
+			return "", err
+		}
+		grandparentID, err := parentID(dir)
+		if err != nil {
+			return "", err
+		}
+		n, err := lookup(grandparentID, path.Base(dir))
+		if err != nil {
+			return "", err
+		}
+		if n == nil {
+			rawID, err := uuid.NewV4()
+			if err != nil {
+				return "", err
+			}
+			n = &node{id: rawID.String()}
+			_, err = tx.ExecContext(ctx, "INSERT INTO nodes (id, parent_id, name, fold_name, placeholder) VALUES (?,?,?,?,1)",
+				n.id, grandparentID, path.Base(dir), s.pathKey(path.Base(dir)))
+			if err != nil {
+				return "", err
+			}
+		}
+		cache.add(s.pathKey(dir), n.id, time.Time{})
+		return n.id, nil
+	}
+
+	for {
+		rec, err := ar.next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		key := s.pathKey(rec.Path)
+		if _, ok := cache.get(key); ok {
+			return 0, newGRPCError(ctx, codes.InvalidArgument, reasonInvalidArchive, "",
+				"record at line %d repeats a path or follows its descendants", ar.line)
+		}
+		pid, err := parentID(rec.Path)
+		if err != nil {
+			return 0, err
+		}
+		name := path.Base(rec.Path)
+		batch = append(batch, []interface{}{rec.ID, pid, name, s.pathKey(name), rec.Checksum, rec.ETag, rec.MTime})
+		cache.add(key, rec.ID, time.Time{})
+
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	if err := bumpTreeGeneration(ctx, tx); err != nil {
+		return 0, err
+	}
+	return imported, tx.Commit()
+}
+
+func exportCommand(args []string) error {
+	fs, cf := newCommandFlags("export", "-path <path> [-o <file>]")
+	root := fs.String("path", "", "path whose records are exported, usually a home directory")
+	out := fs.String("o", "-", "file the archive is written to, - for stdout")
+	fs.Parse(args)
+
+	if *root == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s, err := newCommandServer(cf)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "-" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	n, err := s.exportRecords(context.Background(), *root, bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && w != os.Stdout {
+		err = w.Close()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d records exported\n", n)
+	return nil
+}
+
+func importCommand(args []string) error {
+	fs, cf := newCommandFlags("import", "[-root <path>] [-preserve-ids] [-replace] [<file>]")
+	opts := &importOptions{}
+	fs.StringVar(&opts.root, "root", "", "path the records are imported under, the exported one by default")
+	fs.BoolVar(&opts.preserveIDs, "preserve-ids", false, "keep the exported ids instead of generating new ones")
+	fs.BoolVar(&opts.replace, "replace", false, "replace the records under root")
+	fs.Parse(args)
+
+	r := os.Stdin
+	if name := fs.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	s, err := newCommandServer(cf)
+	if err != nil {
+		return err
+	}
+
+	n, err := s.importRecords(context.Background(), r, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d records imported\n", n)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"github.com/clawio/service-auth/lib"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	metadata "google.golang.org/grpc/metadata"
+	"math"
+	"strings"
+)
+
+const (
+	authorizationKey = "authorization"
+	bearerPrefix     = "bearer "
+)
+
+// getAccessToken returns the access token of a request.
+// The bearer token in the authorization metadata takes precedence
+// over the token sent in the request message.
+func getAccessToken(ctx context.Context, reqToken string) string {
+
+	md, ok := metadata.FromContext(ctx)
+	if !ok {
+		return reqToken
+	}
+
+	for _, v := range md[authorizationKey] {
+		if len(v) > len(bearerPrefix) && strings.ToLower(v[:len(bearerPrefix)]) == bearerPrefix {
+			return strings.TrimSpace(v[len(bearerPrefix):])
+		}
+	}
+
+	return reqToken
+}
+
+// authenticate returns the identity for the access token of a request.
+// reqToken points to the token field of the request message and it is
+// cleared, as requests are logged by gRPC tracing and we do not want
+// tokens to end up in traces or logs.
+func (s *server) authenticate(ctx context.Context, reqToken *string) (*lib.Identity, string, error) {
+
+	token := getAccessToken(ctx, *reqToken)
+	*reqToken = ""
+
+	idt, err := s.verifier.verify(token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return idt, token, nil
+}
+
+// limit admits a request of idt for method. If admitted, the returned
+// function must be called when the request is done. Otherwise the error
+// carries how many seconds to wait in the retry-after trailer.
+func (s *server) limit(ctx context.Context, method string, idt *lib.Identity) (func(), error) {
+
+	release, retryAfter, ok := s.limits.acquire(method, idt.Pid)
+	if ok {
+		return release, nil
+	}
+
+	rateLimitedCounter.Add(1)
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	md := metadata.Pairs(retryAfterKey, fmt.Sprintf("%d", seconds))
+	return nil, newGRPCErrorWithMD(ctx, md, codes.ResourceExhausted, reasonRateLimited, "",
+		"too many requests, retry after %d seconds", seconds)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// defaultRecordCacheTTL is how long a cached record is served,
+// which bounds how stale Get can be after a change made through
+// another instance.
+const defaultRecordCacheTTL = 5 * time.Second
+
+// recordCache caches the records returned by Get, keyed by path.
+// Every invalidation increases the generation, and a record read from
+// the database is only cached if no invalidation happened since the
+// read started, so a Get racing with a change cannot cache the record
+// the change replaced. It is safe for concurrent use.
+type recordCache struct {
+	ttl time.Duration
+
+	mu         sync.Mutex
+	generation uint64
+	// records is nil when caching is disabled
+	records *lru
+}
+
+// newRecordCache returns a cache of up to size records served for ttl.
+func newRecordCache(size int, ttl time.Duration) *recordCache {
+	c := &recordCache{}
+	c.ttl = ttl
+	if size > 0 {
+		c.records = newLRU(size)
+	}
+	return c
+}
+
+// get returns the record cached for key and the generation to pass
+// to add when it is missing.
+func (c *recordCache) get(key string) (record, uint64, bool) {
+	if c.records == nil {
+		return record{}, 0, false
+	}
+
+	c.mu.Lock()
+	generation := c.generation
+	c.mu.Unlock()
+
+	v, ok := c.records.get(key)
+	if !ok {
+		recordCacheMissesCounter.Add(1)
+		return record{}, generation, false
+	}
+	recordCacheHitsCounter.Add(1)
+	return v.(record), generation, true
+}
+
+// add caches r for key if nothing was invalidated since generation.
+func (c *recordCache) add(generation uint64, key string, r record) {
+	if c.records == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return
+	}
+	c.records.add(key, r, time.Now().Add(c.ttl))
+}
+
+// invalidate drops the records cached for keys.
+func (c *recordCache) invalidate(keys ...string) {
+	if c.records == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, key := range keys {
+		c.records.remove(key)
+	}
+}
+
+// purge drops all the cached records, for changes to whole subtrees.
+func (c *recordCache) purge() {
+	if c.records == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.records.purge()
+}
+
+// getCachedByPath is getByPath through the record cache.
+// Missing records and records read from a replica are not cached.
+func (s *server) getCachedByPath(ctx context.Context, p string) (*record, error) {
+
+	key := s.pathKey(p)
+	r, generation, ok := s.records.get(key)
+	if ok {
+		return &r, nil
+	}
+
+	rec, err := s.getByPath(ctx, p)
+	if err != nil {
+		return rec, err
+	}
+	// a replica may not have caught up with the changes invalidated
+	if !fromReplica(ctx) {
+		s.records.add(generation, key, *rec)
+	}
+	return rec, nil
+}
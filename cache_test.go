@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestRecordCacheExpiry(t *testing.T) {
+	c := newRecordCache(10, time.Millisecond)
+	_, generation, _ := c.get("/a")
+	c.add(generation, "/a", record{ID: "1", Path: "/a"})
+	if r, _, ok := c.get("/a"); !ok || r.ID != "1" {
+		t.Fatalf("get(/a) = %+v, %t", r, ok)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, _, ok := c.get("/a"); ok {
+		t.Error("record served after its ttl")
+	}
+}
+
+func TestReloadPurgesRecordCache(t *testing.T) {
+	for _, s := range settings {
+		t.Setenv(s.envar, "")
+	}
+	t.Setenv(configEnvar, "")
+
+	srv := &server{records: newRecordCache(10, time.Minute)}
+	_, generation, _ := srv.records.get("/a")
+	srv.records.add(generation, "/a", record{ID: "1", Path: "/a"})
+
+	// an invalid configuration is not applied, the cache is dropped
+	// all the same
+	r := newReloader(newConfigFlags(flag.NewFlagSet("test", flag.ContinueOnError)), validConfig(), srv)
+	if err := r.reload(); err == nil {
+		t.Fatal("configuration without a dsn reloaded")
+	}
+	if _, _, ok := srv.records.get("/a"); ok {
+		t.Error("cached record kept after the reload")
+	}
+}
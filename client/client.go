@@ -0,0 +1,468 @@
+// Package client is a client of the Prop service.
+//
+// It takes care of what every caller of the service needs: trace IDs
+// are propagated from the context, idempotent calls are retried with
+// backoff while the service is unavailable, calls are bounded by a
+// timeout and errors are returned as *Error, carrying the reason the
+// service sent along with the status code.
+//
+//	c, err := client.New("service-localfs-prop:57003", nil)
+//	...
+//	ctx = client.WithToken(ctx, token)
+//	rec, err := c.Get(ctx, "/local/users/d/demo/photos/1.png")
+//	if client.IsNotFound(err) {
+//		...
+//	}
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	metadata "google.golang.org/grpc/metadata"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Metadata keys understood by the service.
+const (
+	traceKey         = "trace"
+	authorizationKey = "authorization"
+	reasonKey        = "error-reason"
+	pathKey          = "error-path"
+	retryAfterKey    = "retry-after"
+)
+
+// Reasons sent by the service in the error-reason trailer.
+const (
+	ReasonRecordNotFound      = "RECORD_NOT_FOUND"
+	ReasonRecordAlreadyExists = "RECORD_ALREADY_EXISTS"
+	ReasonCaseCollision       = "CASE_COLLISION"
+	ReasonPreconditionFailed  = "PRECONDITION_FAILED"
+	ReasonInvalidPath         = "INVALID_PATH"
+	ReasonDatabaseUnavailable = "DATABASE_UNAVAILABLE"
+	ReasonTimeout             = "TIMEOUT"
+	ReasonCanceled            = "CANCELED"
+	ReasonRateLimited         = "RATE_LIMITED"
+	ReasonInvalidArchive      = "INVALID_ARCHIVE"
+	ReasonInternal            = "INTERNAL"
+)
+
+// Options configure a Client. The zero value of each field
+// selects its default.
+type Options struct {
+	// PoolSize is the number of connections calls are spread over.
+	// Defaults to 1, a connection multiplexes concurrent calls.
+	PoolSize int
+
+	// Timeout bounds every attempt of a call. A shorter deadline
+	// of the context is kept. Defaults to 30 seconds.
+	Timeout time.Duration
+
+	// MaxRetries is the number of times idempotent calls are retried
+	// while the service is unavailable. Defaults to 3, -1 disables it.
+	MaxRetries int
+
+	// Backoff is the wait before the first retry, doubled on every
+	// retry up to MaxBackoff. They default to 100ms and 2s.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// TLS is the configuration of TLS connections.
+	// Connections are insecure if it is nil.
+	TLS *tls.Config
+
+	// DialOptions are passed to grpc.Dial.
+	DialOptions []grpc.DialOption
+}
+
+func (o *Options) withDefaults() *Options {
+	opts := &Options{}
+	if o != nil {
+		*opts = *o
+	}
+	if opts.PoolSize < 1 {
+		opts.PoolSize = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 2 * time.Second
+	}
+	return opts
+}
+
+// Client calls the Prop service. It is safe for concurrent use.
+type Client struct {
+	opts    *Options
+	conns   []*grpc.ClientConn
+	clients []pb.PropClient
+	admins  []pb.AdminClient
+	next    uint32
+}
+
+// New returns a client of the service listening on addr.
+func New(addr string, opts *Options) (*Client, error) {
+	c := &Client{}
+	c.opts = opts.withDefaults()
+
+	dialOpts := []grpc.DialOption{grpc.WithInsecure()}
+	if c.opts.TLS != nil {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(c.opts.TLS))}
+	}
+	dialOpts = append(dialOpts, c.opts.DialOptions...)
+
+	for i := 0; i < c.opts.PoolSize; i++ {
+		conn, err := grpc.Dial(addr, dialOpts...)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.conns = append(c.conns, conn)
+		c.clients = append(c.clients, pb.NewPropClient(conn))
+		c.admins = append(c.admins, pb.NewAdminClient(conn))
+	}
+	return c, nil
+}
+
+// Close closes the connections of the client.
+func (c *Client) Close() error {
+	var err error
+	for _, conn := range c.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// pick returns the next client of the pool.
+func (c *Client) pick() pb.PropClient {
+	n := atomic.AddUint32(&c.next, 1)
+	return c.clients[int(n)%len(c.clients)]
+}
+
+func (c *Client) pickAdmin() pb.AdminClient {
+	n := atomic.AddUint32(&c.next, 1)
+	return c.admins[int(n)%len(c.admins)]
+}
+
+// Get returns the record of p.
+func (c *Client) Get(ctx context.Context, p string) (*pb.Record, error) {
+	var rec *pb.Record
+	err := c.call(ctx, true, func(ctx context.Context, pc pb.PropClient, opts ...grpc.CallOption) (err error) {
+		rec, err = pc.Get(ctx, &pb.GetReq{Path: p}, opts...)
+		return err
+	})
+	return rec, err
+}
+
+// GetOrCreate returns the record of p, creating it if it does not exist.
+// It is retried as a record created by a failed attempt is found by the
+// next one.
+func (c *Client) GetOrCreate(ctx context.Context, p string) (*pb.Record, error) {
+	var rec *pb.Record
+	err := c.call(ctx, true, func(ctx context.Context, pc pb.PropClient, opts ...grpc.CallOption) (err error) {
+		rec, err = pc.Get(ctx, &pb.GetReq{Path: p, ForceCreation: true}, opts...)
+		return err
+	})
+	return rec, err
+}
+
+// List returns the children of p ordered by path, or every descendant
+// if recursive is set.
+func (c *Client) List(ctx context.Context, p string, recursive bool) ([]*pb.Record, error) {
+	var res *pb.Records
+	err := c.call(ctx, true, func(ctx context.Context, pc pb.PropClient, opts ...grpc.CallOption) (err error) {
+		res, err = pc.List(ctx, &pb.ListReq{Path: p, Recursive: recursive}, opts...)
+		return err
+	})
+	return res.GetRecords(), err
+}
+
+// Put creates or updates the record of p and propagates the change
+// to its ancestors. It is not retried, as every call changes the ETag.
+func (c *Client) Put(ctx context.Context, p, checksum string) error {
+	return c.call(ctx, false, func(ctx context.Context, pc pb.PropClient, opts ...grpc.CallOption) error {
+		_, err := pc.Put(ctx, &pb.PutReq{Path: p, Checksum: checksum}, opts...)
+		return err
+	})
+}
+
+// Mv moves the records under src to dst. It is not retried.
+func (c *Client) Mv(ctx context.Context, src, dst string) error {
+	return c.call(ctx, false, func(ctx context.Context, pc pb.PropClient, opts ...grpc.CallOption) error {
+		_, err := pc.Mv(ctx, &pb.MvReq{Src: src, Dst: dst}, opts...)
+		return err
+	})
+}
+
+// Rm removes the records under p. It is not retried.
+func (c *Client) Rm(ctx context.Context, p string) error {
+	return c.call(ctx, false, func(ctx context.Context, pc pb.PropClient, opts ...grpc.CallOption) error {
+		_, err := pc.Rm(ctx, &pb.RmReq{Path: p}, opts...)
+		return err
+	})
+}
+
+// ImportOptions select how Import imports an archive.
+type ImportOptions struct {
+	// Root is the path the records are imported under,
+	// the exported one if empty.
+	Root string
+
+	// PreserveIDs keeps the exported IDs instead of generating new ones.
+	PreserveIDs bool
+
+	// Replace replaces the records under Root instead of failing
+	// if there are any.
+	Replace bool
+}
+
+// importChunkSize is the size of the archive chunks sent by Import.
+const importChunkSize = 64 << 10
+
+// Export writes the archive of the records under p to w. Only admin
+// users can call it. Like Import it is not retried and, as archives
+// can be large, only bounded by the deadline of ctx.
+func (c *Client) Export(ctx context.Context, p string, w io.Writer) error {
+	ctx = withTraceID(ctx)
+	stream, err := c.pickAdmin().Export(ctx, &pb.ExportReq{Path: p})
+	if err != nil {
+		return newError(err, nil)
+	}
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return newError(err, stream.Trailer())
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// Import imports the archive read from r and returns the number of
+// records imported. Only admin users can call it.
+func (c *Client) Import(ctx context.Context, r io.Reader, opts *ImportOptions) (uint64, error) {
+	ctx = withTraceID(ctx)
+	stream, err := c.pickAdmin().Import(ctx)
+	if err != nil {
+		return 0, newError(err, nil)
+	}
+
+	req := &pb.ImportReq{}
+	if opts != nil {
+		req.Root = opts.Root
+		req.PreserveIds = opts.PreserveIDs
+		req.Replace = opts.Replace
+	}
+	buf := make([]byte, importChunkSize)
+	for first := true; ; first = false {
+		n, rerr := io.ReadFull(r, buf)
+		// the first message carries the options even if r is empty
+		if n > 0 || first {
+			req.Data = append([]byte{}, buf[:n]...)
+			if err := stream.Send(req); err != nil {
+				// the service ended the call, its error is
+				// returned by CloseAndRecv
+				break
+			}
+			req = &pb.ImportReq{}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			stream.CloseSend()
+			return 0, rerr
+		}
+	}
+
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return 0, newError(err, stream.Trailer())
+	}
+	return res.Imported, nil
+}
+
+// call runs f with the trace ID of ctx, retrying it while the
+// service is unavailable if idempotent is set.
+func (c *Client) call(ctx context.Context, idempotent bool, f func(ctx context.Context, pc pb.PropClient, opts ...grpc.CallOption) error) error {
+
+	ctx = withTraceID(ctx)
+	backoff := c.opts.Backoff
+
+	for attempt := 0; ; attempt++ {
+		actx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+		var trailer metadata.MD
+		err := f(actx, c.pick(), grpc.Trailer(&trailer))
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if !idempotent || grpc.Code(err) != codes.Unavailable || attempt >= c.opts.MaxRetries {
+			return newError(err, trailer)
+		}
+
+		// full jitter avoids all callers retrying at once
+		wait := time.Duration(rand.Int63n(int64(backoff)) + 1)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return newError(err, trailer)
+		}
+
+		backoff *= 2
+		if backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// WithToken returns a context whose calls are authenticated with token.
+func WithToken(ctx context.Context, token string) context.Context {
+	return withMetadata(ctx, authorizationKey, "Bearer "+token)
+}
+
+// WithTraceID returns a context whose calls carry the trace ID id.
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return withMetadata(ctx, traceKey, id)
+}
+
+// TraceID returns the trace ID of ctx, or an empty string if it has none.
+// The trace ID of a request received by a gRPC server is found in its
+// context, so passing that context on keeps the same trace ID.
+func TraceID(ctx context.Context) string {
+	md, ok := metadata.FromContext(ctx)
+	if !ok || len(md[traceKey]) == 0 {
+		return ""
+	}
+	return md[traceKey][0]
+}
+
+// withTraceID makes sure ctx carries a trace ID so that all the
+// attempts of a call are logged under the same one.
+func withTraceID(ctx context.Context) context.Context {
+	if TraceID(ctx) != "" {
+		return ctx
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		// the service generates one
+		return ctx
+	}
+	return WithTraceID(ctx, id.String())
+}
+
+func withMetadata(ctx context.Context, key, value string) context.Context {
+	md, ok := metadata.FromContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	md[key] = []string{value}
+	return metadata.NewContext(ctx, md)
+}
+
+// Error is an error returned by the service.
+type Error struct {
+	Code    codes.Code
+	Message string
+
+	// Reason is one of the Reason constants, empty if the
+	// service did not send one.
+	Reason string
+
+	// Path is the path the error refers to, if any.
+	Path string
+
+	// RetryAfter is how long to wait before retrying a rate limited call.
+	RetryAfter time.Duration
+}
+
+func newError(err error, trailer metadata.MD) *Error {
+	e := &Error{}
+	e.Code = grpc.Code(err)
+	e.Message = grpc.ErrorDesc(err)
+	if v := trailer[reasonKey]; len(v) > 0 {
+		e.Reason = v[0]
+	}
+	if v := trailer[pathKey]; len(v) > 0 {
+		e.Path = v[0]
+	}
+	if v := trailer[retryAfterKey]; len(v) > 0 {
+		if seconds, err := strconv.Atoi(v[0]); err == nil {
+			e.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Code, e.Message)
+	if e.Reason != "" {
+		msg += fmt.Sprintf(" (%s)", e.Reason)
+	}
+	return msg
+}
+
+// Code returns the status code of err, codes.OK if it is nil and
+// codes.Unknown if it was not returned by the service.
+func Code(err error) codes.Code {
+	if err == nil {
+		return codes.OK
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return codes.Unknown
+}
+
+// Reason returns the reason of err, empty if it has none.
+func Reason(err error) string {
+	if e, ok := err.(*Error); ok {
+		return e.Reason
+	}
+	return ""
+}
+
+// IsNotFound tells if err is caused by a missing record.
+func IsNotFound(err error) bool {
+	return Code(err) == codes.NotFound
+}
+
+// IsAlreadyExists tells if err is caused by a record that already
+// exists, which includes records only differing in case.
+func IsAlreadyExists(err error) bool {
+	return Code(err) == codes.AlreadyExists
+}
+
+// IsRetryable tells if the call failing with err may succeed later.
+func IsRetryable(err error) bool {
+	switch Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
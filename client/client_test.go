@@ -0,0 +1,314 @@
+package client
+
+import (
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is an in-process Prop service whose handlers are
+// replaced by each test. It records the metadata of every call.
+type fakeServer struct {
+	mu    sync.Mutex
+	calls []metadata.MD
+
+	get func(ctx context.Context, req *pb.GetReq) (*pb.Record, error)
+	put func(ctx context.Context, req *pb.PutReq) (*pb.Void, error)
+}
+
+func (s *fakeServer) record(ctx context.Context) {
+	md, _ := metadata.FromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, md)
+}
+
+func (s *fakeServer) numCalls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.calls)
+}
+
+func (s *fakeServer) call(i int) metadata.MD {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[i]
+}
+
+func (s *fakeServer) Get(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
+	s.record(ctx)
+	if s.get == nil {
+		return &pb.Record{Path: req.Path}, nil
+	}
+	return s.get(ctx, req)
+}
+
+func (s *fakeServer) Put(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
+	s.record(ctx)
+	if s.put == nil {
+		return &pb.Void{}, nil
+	}
+	return s.put(ctx, req)
+}
+
+func (s *fakeServer) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
+	s.record(ctx)
+	return &pb.Void{}, nil
+}
+
+func (s *fakeServer) Rm(ctx context.Context, req *pb.RmReq) (*pb.Void, error) {
+	s.record(ctx)
+	return &pb.Void{}, nil
+}
+
+func (s *fakeServer) List(ctx context.Context, req *pb.ListReq) (*pb.Records, error) {
+	s.record(ctx)
+	return &pb.Records{}, nil
+}
+
+// newTestClient serves fake on a loopback listener and returns a
+// client of it with short backoffs.
+func newTestClient(t *testing.T, fake *fakeServer, opts *Options) *Client {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterPropServer(srv, fake)
+	go srv.Serve(lis)
+
+	if opts == nil {
+		opts = &Options{}
+	}
+	opts.Backoff = time.Millisecond
+	opts.MaxBackoff = 5 * time.Millisecond
+	c, err := New(lis.Addr().String(), opts)
+	if err != nil {
+		srv.Stop()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		srv.Stop()
+	})
+	return c
+}
+
+func failTimes(n int, code codes.Code) func(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
+	var mu sync.Mutex
+	return func(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if n > 0 {
+			n--
+			return nil, grpc.Errorf(code, "failing")
+		}
+		return &pb.Record{Path: req.Path}, nil
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		code       codes.Code
+		maxRetries int
+		wantCalls  int
+		wantCode   codes.Code
+	}{
+		{"succeeds after unavailable", 2, codes.Unavailable, 0, 3, codes.OK},
+		{"gives up after max retries", 10, codes.Unavailable, 2, 3, codes.Unavailable},
+		{"retries disabled", 10, codes.Unavailable, -1, 1, codes.Unavailable},
+		{"not found is not retried", 10, codes.NotFound, 0, 1, codes.NotFound},
+		{"internal is not retried", 10, codes.Internal, 0, 1, codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeServer{get: failTimes(tt.failures, tt.code)}
+			c := newTestClient(t, fake, &Options{MaxRetries: tt.maxRetries})
+
+			_, err := c.Get(context.Background(), "/a")
+			if got := Code(err); got != tt.wantCode {
+				t.Fatalf("code = %s, want %s (err %v)", got, tt.wantCode, err)
+			}
+			if got := fake.numCalls(); got != tt.wantCalls {
+				t.Fatalf("calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestNonIdempotentCallsAreNotRetried(t *testing.T) {
+	fake := &fakeServer{}
+	fake.put = func(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
+		return nil, grpc.Errorf(codes.Unavailable, "down")
+	}
+	c := newTestClient(t, fake, nil)
+
+	err := c.Put(context.Background(), "/a", "")
+	if Code(err) != codes.Unavailable {
+		t.Fatalf("code = %s, want %s", Code(err), codes.Unavailable)
+	}
+	if got := fake.numCalls(); got != 1 {
+		t.Fatalf("calls = %d, want 1", got)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	fake := &fakeServer{}
+	c := newTestClient(t, fake, nil)
+
+	ctx := WithToken(context.Background(), "secret")
+	ctx = WithTraceID(ctx, "trace-1")
+	if _, err := c.Get(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	md := fake.call(0)
+	if got := md[authorizationKey]; len(got) != 1 || got[0] != "Bearer secret" {
+		t.Errorf("authorization = %v, want [Bearer secret]", got)
+	}
+	if got := md[traceKey]; len(got) != 1 || got[0] != "trace-1" {
+		t.Errorf("trace = %v, want [trace-1]", got)
+	}
+}
+
+func TestTraceIDIsKeptAcrossRetries(t *testing.T) {
+	fake := &fakeServer{get: failTimes(2, codes.Unavailable)}
+	c := newTestClient(t, fake, nil)
+
+	if _, err := c.Get(context.Background(), "/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	first := fake.call(0)[traceKey]
+	if len(first) != 1 || first[0] == "" {
+		t.Fatalf("trace = %v, want a generated trace ID", first)
+	}
+	for i := 1; i < fake.numCalls(); i++ {
+		if got := fake.call(i)[traceKey]; len(got) != 1 || got[0] != first[0] {
+			t.Errorf("attempt %d trace = %v, want %v", i, got, first)
+		}
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           codes.Code
+		trailer        metadata.MD
+		wantReason     string
+		wantPath       string
+		wantRetryAfter time.Duration
+		notFound       bool
+		alreadyExists  bool
+		retryable      bool
+	}{
+		{
+			name:       "not found",
+			code:       codes.NotFound,
+			trailer:    metadata.MD{reasonKey: {ReasonRecordNotFound}, pathKey: {"/a"}},
+			wantReason: ReasonRecordNotFound,
+			wantPath:   "/a",
+			notFound:   true,
+		},
+		{
+			name:          "case collision",
+			code:          codes.AlreadyExists,
+			trailer:       metadata.MD{reasonKey: {ReasonCaseCollision}, pathKey: {"/A"}},
+			wantReason:    ReasonCaseCollision,
+			wantPath:      "/A",
+			alreadyExists: true,
+		},
+		{
+			name:           "rate limited",
+			code:           codes.ResourceExhausted,
+			trailer:        metadata.MD{reasonKey: {ReasonRateLimited}, retryAfterKey: {"3"}},
+			wantReason:     ReasonRateLimited,
+			wantRetryAfter: 3 * time.Second,
+			retryable:      true,
+		},
+		{
+			name:    "no trailer",
+			code:    codes.InvalidArgument,
+			trailer: metadata.MD{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeServer{}
+			fake.get = func(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
+				grpc.SetTrailer(ctx, tt.trailer)
+				return nil, grpc.Errorf(tt.code, "failing")
+			}
+			c := newTestClient(t, fake, nil)
+
+			_, err := c.Get(context.Background(), "/a")
+			e, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("error %T %v is not an *Error", err, err)
+			}
+			if e.Code != tt.code {
+				t.Errorf("code = %s, want %s", e.Code, tt.code)
+			}
+			if e.Message != "failing" {
+				t.Errorf("message = %q, want %q", e.Message, "failing")
+			}
+			if e.Reason != tt.wantReason || Reason(err) != tt.wantReason {
+				t.Errorf("reason = %q, want %q", e.Reason, tt.wantReason)
+			}
+			if e.Path != tt.wantPath {
+				t.Errorf("path = %q, want %q", e.Path, tt.wantPath)
+			}
+			if e.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("retry after = %s, want %s", e.RetryAfter, tt.wantRetryAfter)
+			}
+			if IsNotFound(err) != tt.notFound {
+				t.Errorf("IsNotFound = %t, want %t", IsNotFound(err), tt.notFound)
+			}
+			if IsAlreadyExists(err) != tt.alreadyExists {
+				t.Errorf("IsAlreadyExists = %t, want %t", IsAlreadyExists(err), tt.alreadyExists)
+			}
+			if IsRetryable(err) != tt.retryable {
+				t.Errorf("IsRetryable = %t, want %t", IsRetryable(err), tt.retryable)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	fake := &fakeServer{}
+	fake.get = func(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	c := newTestClient(t, fake, &Options{Timeout: 50 * time.Millisecond, MaxRetries: -1})
+
+	_, err := c.Get(context.Background(), "/a")
+	if Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("code = %s, want %s", Code(err), codes.DeadlineExceeded)
+	}
+}
+
+func TestPoolSpreadsCalls(t *testing.T) {
+	fake := &fakeServer{}
+	c := newTestClient(t, fake, &Options{PoolSize: 3})
+
+	if len(c.conns) != 3 {
+		t.Fatalf("conns = %d, want 3", len(c.conns))
+	}
+	for i := 0; i < 6; i++ {
+		if _, err := c.Get(context.Background(), "/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := fake.numCalls(); got != 6 {
+		t.Fatalf("calls = %d, want 6", got)
+	}
+}
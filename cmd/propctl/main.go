@@ -0,0 +1,388 @@
+// Command propctl is a command line client of the Prop service.
+//
+//	propctl [flags] get [-force] <path>
+//	propctl [flags] put <path> [checksum]
+//	propctl [flags] mv <src> <dst>
+//	propctl [flags] rm <path>
+//	propctl [flags] list [-r] <path>
+//	propctl [flags] tree <path>
+//	propctl [flags] export <path> [file]
+//	propctl [flags] import [-root <path>] [-preserve-ids] [-replace] [file]
+//
+// The access token is read from -token-file, "-" being the standard
+// input, or from the PROPCTL_TOKEN environment variable.
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/clawio/service-localfs-prop/client"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	addrEnvar  = "PROPCTL_ADDR"
+	tokenEnvar = "PROPCTL_TOKEN"
+)
+
+var (
+	addr      = flag.String("addr", envOr(addrEnvar, "localhost:57003"), "address of the Prop service, also read from "+addrEnvar)
+	tokenFile = flag.String("token-file", "", "file with the access token, - for the standard input")
+	traceID   = flag.String("trace", "", "trace ID sent with the request, a random one by default")
+	output    = flag.String("o", "table", "output format: table or json")
+	timeout   = flag.Duration("timeout", 30*time.Second, "timeout of the request")
+	useTLS    = flag.Bool("tls", false, "connect using TLS")
+	caFile    = flag.String("ca", "", "CA bundle to verify the service certificate, implies -tls")
+	certFile  = flag.String("cert", "", "client certificate file, implies -tls")
+	keyFile   = flag.String("key", "", "client key file")
+)
+
+func envOr(envar, def string) string {
+	if v := os.Getenv(envar); v != "" {
+		return v
+	}
+	return def
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: propctl [flags] <command> [args]
+
+commands:
+  get [-force] <path>    print the record of path, -force creates it if missing
+  put <path> [checksum]  create or update the record of path
+  mv <src> <dst>         move the records under src to dst
+  rm <path>              remove the records under path
+  list [-r] <path>       list the children of path, -r lists every descendant
+  tree <path>            print the subtree of path with ETags and mtimes
+  export <path> [file]   write the archive of the records under path, admin only
+  import [-root <path>] [-preserve-ids] [-replace] [file]
+                         import an archive made by export, admin only
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *output != "table" && *output != "json" {
+		fatalf("unknown output format %q", *output)
+	}
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	run, ok := commands[cmd]
+	if !ok {
+		fatalf("unknown command %q", cmd)
+	}
+
+	token, err := readToken()
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	if *traceID == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			fatalf("%s", err)
+		}
+		*traceID = id.String()
+	}
+
+	opts := &client.Options{}
+	opts.Timeout = *timeout
+	opts.TLS, err = tlsConfig()
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	c, err := client.New(*addr, opts)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	defer c.Close()
+
+	ctx := client.WithTraceID(context.Background(), *traceID)
+	if token != "" {
+		ctx = client.WithToken(ctx, token)
+	}
+
+	if err := run(ctx, c, args); err != nil {
+		c.Close()
+		fail(err)
+	}
+}
+
+var commands = map[string]func(ctx context.Context, c *client.Client, args []string) error{
+	"get":    get,
+	"put":    put,
+	"mv":     mv,
+	"rm":     rm,
+	"list":   list,
+	"tree":   tree,
+	"export": export,
+	"import": importArchive,
+}
+
+func get(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	force := fs.Bool("force", false, "create the record if it does not exist")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: get [-force] <path>")
+	}
+
+	get := c.Get
+	if *force {
+		get = c.GetOrCreate
+	}
+	rec, err := get(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printRecords([]*pb.Record{rec})
+}
+
+func put(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: put <path> [checksum]")
+	}
+	checksum := ""
+	if len(args) == 2 {
+		checksum = args[1]
+	}
+	return c.Put(ctx, args[0], checksum)
+}
+
+func mv(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: mv <src> <dst>")
+	}
+	return c.Mv(ctx, args[0], args[1])
+}
+
+func rm(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: rm <path>")
+	}
+	return c.Rm(ctx, args[0])
+}
+
+func list(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	recursive := fs.Bool("r", false, "list every descendant")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: list [-r] <path>")
+	}
+
+	recs, err := c.List(ctx, fs.Arg(0), *recursive)
+	if err != nil {
+		return err
+	}
+	return printRecords(recs)
+}
+
+// tree prints the record of the root, if any, and all its descendants
+// indented by depth, which makes propagation easy to follow: every
+// directory must be at least as new as its newest descendant.
+func tree(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: tree <path>")
+	}
+	root := args[0]
+
+	recs := []*pb.Record{}
+
+	// directories do not always have a record of their own
+	rec, err := c.Get(ctx, root)
+	if err != nil && !client.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		recs = append(recs, rec)
+		root = rec.Path
+	}
+
+	descendants, err := c.List(ctx, root, true)
+	if err != nil {
+		return err
+	}
+	recs = append(recs, descendants...)
+
+	if *output == "json" {
+		return printJSON(recs)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tETAG\tMTIME")
+	base := strings.Count(path.Clean(root), "/")
+	for _, r := range recs {
+		depth := strings.Count(r.Path, "/") - base
+		name := path.Base(r.Path)
+		if depth == 0 {
+			name = r.Path
+		}
+		fmt.Fprintf(w, "%s%s\t%s\t%s\n", strings.Repeat("  ", depth), name, r.Etag, formatMTime(r.Modified))
+	}
+	return w.Flush()
+}
+
+// export writes the archive to file, or to the standard output.
+func export(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: export <path> [file]")
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if len(args) == 2 && args[1] != "-" {
+		f, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = bufio.NewWriter(f)
+	}
+
+	if err := c.Export(ctx, args[0], w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// importArchive reads the archive from file, or from the standard input.
+func importArchive(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	opts := &client.ImportOptions{}
+	fs.StringVar(&opts.Root, "root", "", "path the records are imported under, the exported one by default")
+	fs.BoolVar(&opts.PreserveIDs, "preserve-ids", false, "keep the exported ids instead of generating new ones")
+	fs.BoolVar(&opts.Replace, "replace", false, "replace the records under root")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return fmt.Errorf("usage: import [-root <path>] [-preserve-ids] [-replace] [file]")
+	}
+
+	var r io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	n, err := c.Import(ctx, r, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d records imported\n", n)
+	return nil
+}
+
+func printRecords(recs []*pb.Record) error {
+	if *output == "json" {
+		return printJSON(recs)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPATH\tETAG\tMTIME\tCHECKSUM")
+	for _, r := range recs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Id, r.Path, r.Etag, formatMTime(r.Modified), r.Checksum)
+	}
+	return w.Flush()
+}
+
+func printJSON(recs []*pb.Record) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(recs)
+}
+
+func formatMTime(mtime uint32) string {
+	return time.Unix(int64(mtime), 0).UTC().Format(time.RFC3339)
+}
+
+// readToken returns the access token. Tokens are not accepted as
+// flags as they would be visible in the process list.
+func readToken() (string, error) {
+	if *tokenFile == "" {
+		return os.Getenv(tokenEnvar), nil
+	}
+
+	var r io.Reader
+	if *tokenFile == "-" {
+		r = bufio.NewReader(os.Stdin)
+	} else {
+		f, err := os.Open(*tokenFile)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// tlsConfig returns the TLS configuration of the connection,
+// nil if TLS is not used.
+func tlsConfig() (*tls.Config, error) {
+	if !*useTLS && *caFile == "" && *certFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if *caFile != "" {
+		data, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", *caFile)
+		}
+	}
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// fail reports err along with the trace ID, which is what operators
+// look for in the service logs.
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "propctl: %s [trace %s]\n", err, *traceID)
+	os.Exit(1)
+}
+
+func fatalf(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "propctl: "+format+"\n", a...)
+	os.Exit(1)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// subcommands are maintenance tasks run as
+// service-localfs-prop <subcommand> [flags] instead of the service.
+// They take the same configuration as the service.
+var subcommands = map[string]func(args []string) error{
+	"reconcile":      reconcileCommand,
+	"fsck":           fsckCommand,
+	"export":         exportCommand,
+	"import":         importCommand,
+	"migrate":        migrateCommand,
+	"convert-layout": convertLayoutCommand,
+	"normalize":      normalizeCommand,
+}
+
+// newCommandFlags returns the flag set of a subcommand with
+// the configuration flags already defined.
+func newCommandFlags(name, usage string) (*flag.FlagSet, *configFlags) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s %s\n\nflags:\n", os.Args[0], name, usage)
+		fs.PrintDefaults()
+	}
+	return fs, newConfigFlags(fs)
+}
+
+// newCommandServer returns the server configured for a subcommand.
+// The flag set must have been parsed.
+func newCommandServer(cf *configFlags) (*server, error) {
+	c, err := cf.load()
+	if err != nil {
+		return nil, err
+	}
+	setLogLevel(c)
+	return newServer(newServerParamsFromConfig(c))
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	configEnvar = serviceID + "_CONFIG"
+
+	redacted = "******"
+)
+
+// config is the configuration of the service.
+// Settings are read, from lowest to highest precedence, from the
+// defaults, the YAML configuration file, the environment and the
+// command line flags.
+type config struct {
+	Port              int    `yaml:"port"`
+	DSN               string `yaml:"dsn"`
+	LogLevel          string `yaml:"log_level"`
+	MaxSQLIdle        int    `yaml:"max_sql_idle"`
+	MaxSQLConcurrency int    `yaml:"max_sql_concurrency"`
+	SharedSecret      string `yaml:"shared_secret"`
+	DebugPort         int    `yaml:"debug_port"`
+	HTTPPort          int    `yaml:"http_port"`
+	DAVPrefix         string `yaml:"dav_prefix"`
+
+	Normalization   string `yaml:"normalization"`
+	CaseInsensitive bool   `yaml:"case_insensitive"`
+	HomeDepth       int    `yaml:"home_depth"`
+	Layout          string `yaml:"layout"`
+
+	RecordCacheSize int           `yaml:"record_cache_size"`
+	RecordCacheTTL  time.Duration `yaml:"record_cache_ttl"`
+
+	ReplicaDSNs          []string      `yaml:"replica_dsns"`
+	ReadYourWritesWindow time.Duration `yaml:"read_your_writes_window"`
+
+	TLSCert     string `yaml:"tls_cert"`
+	TLSKey      string `yaml:"tls_key"`
+	TLSClientCA string `yaml:"tls_client_ca"`
+
+	JWTAlgorithms  []string          `yaml:"jwt_algorithms"`
+	JWTPublicKeys  map[string]string `yaml:"jwt_public_keys"`
+	JWKS           string            `yaml:"jwks"`
+	TokenCacheSize int               `yaml:"token_cache_size"`
+	AdminUsers     []string          `yaml:"admin_users"`
+
+	RateLimits map[string]methodLimits  `yaml:"rate_limits"`
+	Timeouts   map[string]time.Duration `yaml:"timeouts"`
+}
+
+func defaultConfig() *config {
+	c := &config{}
+	c.Port = 57003
+	c.LogLevel = "error"
+	c.MaxSQLIdle = 1024
+	c.MaxSQLConcurrency = 1024
+	c.Normalization = "nfc"
+	c.HomeDepth = defaultHomeDepth
+	c.Layout = layoutPath
+	c.RecordCacheTTL = defaultRecordCacheTTL
+	c.ReadYourWritesWindow = defaultReadYourWritesWindow
+	c.TokenCacheSize = defaultTokenCacheSize
+	c.JWTPublicKeys = map[string]string{}
+	c.RateLimits = map[string]methodLimits{}
+	c.Timeouts = map[string]time.Duration{defaultLimitsKey: defaultTimeout}
+	return c
+}
+
+// setting maps a configuration key to its environment variable.
+// The command line flag is the key with dashes instead of underscores.
+type setting struct {
+	key   string
+	envar string
+	usage string
+	set   func(c *config, v string) error
+}
+
+func setInt(dst *int, v string) error {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*dst = i
+	return nil
+}
+
+// settings are the configuration keys that can be overridden
+// from the environment and the command line.
+var settings = []setting{
+	{"port", portEnvar, "port of the gRPC listener",
+		func(c *config, v string) error { return setInt(&c.Port, v) }},
+	{"dsn", dsnEnvar, "MySQL data source name",
+		func(c *config, v string) error { c.DSN = v; return nil }},
+	{"log_level", logLevelEnvar, "log level",
+		func(c *config, v string) error { c.LogLevel = v; return nil }},
+	{"max_sql_idle", maxSqlIdleEnvar, "maximum number of idle database connections",
+		func(c *config, v string) error { return setInt(&c.MaxSQLIdle, v) }},
+	{"max_sql_concurrency", maxSqlConcurrencyEnvar, "maximum number of open database connections",
+		func(c *config, v string) error { return setInt(&c.MaxSQLConcurrency, v) }},
+	{"shared_secret", sharedSecretEnvar, "secret to verify HMAC tokens",
+		func(c *config, v string) error { c.SharedSecret = v; return nil }},
+	{"debug_port", debugPortEnvar, "port of the debug listener on localhost, 0 disables it",
+		func(c *config, v string) error { return setInt(&c.DebugPort, v) }},
+	{"http_port", httpPortEnvar, "port of the HTTP/JSON gateway, 0 disables it",
+		func(c *config, v string) error { return setInt(&c.HTTPPort, v) }},
+	{"dav_prefix", davPrefixEnvar, "path prefix of the WebDAV PROPFIND responder in the gateway, empty disables it",
+		func(c *config, v string) error { c.DAVPrefix = v; return nil }},
+	{"normalization", normalizationEnvar, "Unicode normalization of paths: nfc, nfd, nfkc, nfkd or none",
+		func(c *config, v string) error { c.Normalization = v; return nil }},
+	{"case_insensitive", caseInsensitiveEnvar, "make paths only differing in case refer to the same record, folding a rune at a time (ß and ss differ)",
+		func(c *config, v string) error {
+			b, err := strconv.ParseBool(v)
+			c.CaseInsensitive = b
+			return err
+		}},
+	{"home_depth", homeDepthEnvar, "path elements of a home directory, changes propagate up to it",
+		func(c *config, v string) error { return setInt(&c.HomeDepth, v) }},
+	{"layout", layoutEnvar, "storage layout of the records: path or tree",
+		func(c *config, v string) error { c.Layout = v; return nil }},
+	{"record_cache_size", recordCacheSizeEnvar, "number of records cached for Get, 0 disables it",
+		func(c *config, v string) error { return setInt(&c.RecordCacheSize, v) }},
+	{"record_cache_ttl", recordCacheTTLEnvar, "how long a record is cached for Get",
+		func(c *config, v string) error {
+			d, err := time.ParseDuration(v)
+			c.RecordCacheTTL = d
+			return err
+		}},
+	{"replica_dsns", replicaDSNsEnvar, "comma separated list of the DSNs of read replicas for Get and List",
+		func(c *config, v string) error {
+			c.ReplicaDSNs = nil
+			for _, dsn := range strings.Split(v, ",") {
+				if dsn = strings.TrimSpace(dsn); dsn != "" {
+					c.ReplicaDSNs = append(c.ReplicaDSNs, dsn)
+				}
+			}
+			return nil
+		}},
+	{"read_your_writes_window", readYourWritesEnvar, "how long the reads of a caller go to the primary after it writes, 0 disables it",
+		func(c *config, v string) error {
+			d, err := time.ParseDuration(v)
+			c.ReadYourWritesWindow = d
+			return err
+		}},
+	{"tls_cert", tlsCertEnvar, "TLS certificate file",
+		func(c *config, v string) error { c.TLSCert = v; return nil }},
+	{"tls_key", tlsKeyEnvar, "TLS key file",
+		func(c *config, v string) error { c.TLSKey = v; return nil }},
+	{"tls_client_ca", tlsClientCAEnvar, "CA bundle to verify client certificates",
+		func(c *config, v string) error { c.TLSClientCA = v; return nil }},
+	{"jwt_algorithms", jwtAlgorithmsEnvar, "comma separated list of accepted JWT algorithms",
+		func(c *config, v string) error {
+			c.JWTAlgorithms = nil
+			for _, alg := range strings.Split(v, ",") {
+				if alg = strings.TrimSpace(alg); alg != "" {
+					c.JWTAlgorithms = append(c.JWTAlgorithms, alg)
+				}
+			}
+			return nil
+		}},
+	{"jwt_public_keys", jwtPublicKeysEnvar, "comma separated list of kid=file public keys",
+		func(c *config, v string) error { c.JWTPublicKeys = parsePublicKeys(v); return nil }},
+	{"jwks", jwksEnvar, "JWKS file",
+		func(c *config, v string) error { c.JWKS = v; return nil }},
+	{"token_cache_size", tokenCacheSizeEnvar, "number of verified tokens cached, 0 disables it",
+		func(c *config, v string) error { return setInt(&c.TokenCacheSize, v) }},
+	{"admin_users", adminUsersEnvar, "comma separated list of the pids allowed to call the Admin service",
+		func(c *config, v string) error {
+			c.AdminUsers = nil
+			for _, pid := range strings.Split(v, ",") {
+				if pid = strings.TrimSpace(pid); pid != "" {
+					c.AdminUsers = append(c.AdminUsers, pid)
+				}
+			}
+			return nil
+		}},
+	{"rate_limits", rateLimitsEnvar, "comma separated list of method=rate:burst:inflight limits",
+		func(c *config, v string) error {
+			limits, err := parseLimits(v)
+			c.RateLimits = limits
+			return err
+		}},
+	{"timeouts", timeoutsEnvar, "comma separated list of method=duration timeouts",
+		func(c *config, v string) error {
+			timeouts, err := parseTimeouts(v)
+			c.Timeouts = timeouts
+			return err
+		}},
+}
+
+// configFlags are the command line flags of the configuration.
+type configFlags struct {
+	fs          *flag.FlagSet
+	file        *string
+	printConfig *bool
+	values      map[string]*string
+}
+
+func newConfigFlags(fs *flag.FlagSet) *configFlags {
+	cf := &configFlags{fs: fs, values: map[string]*string{}}
+	cf.file = fs.String("config", "", "YAML configuration file, also read from "+configEnvar)
+	cf.printConfig = fs.Bool("print-config", false, "print the effective configuration and exit")
+	for _, s := range settings {
+		// secrets do not belong in the process list
+		if s.key == "shared_secret" {
+			continue
+		}
+		cf.values[s.key] = fs.String(flagName(s.key), "", s.usage)
+	}
+	return cf
+}
+
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+// load returns the validated configuration. The flag set must
+// have been parsed.
+func (cf *configFlags) load() (*config, error) {
+
+	c := defaultConfig()
+
+	file := *cf.file
+	if file == "" {
+		file = os.Getenv(configEnvar)
+	}
+	if file != "" {
+		if err := c.readFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	problems := []string{}
+	for _, s := range settings {
+		if v := os.Getenv(s.envar); v != "" {
+			if err := s.set(c, v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", s.envar, err))
+			}
+		}
+	}
+
+	visited := map[string]bool{}
+	cf.fs.Visit(func(f *flag.Flag) { visited[f.Name] = true })
+	for _, s := range settings {
+		v, ok := cf.values[s.key]
+		if !ok || !visited[flagName(s.key)] {
+			continue
+		}
+		if err := s.set(c, *v); err != nil {
+			problems = append(problems, fmt.Sprintf("-%s: %s", flagName(s.key), err))
+		}
+	}
+
+	problems = append(problems, c.validate()...)
+	if len(problems) > 0 {
+		return nil, &configError{problems}
+	}
+	return c, nil
+}
+
+func (c *config) readFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	// unknown keys are rejected as they are likely typos
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	return nil
+}
+
+// configError reports all the problems found in a configuration
+// at once instead of making operators fix them one by one.
+type configError struct {
+	problems []string
+}
+
+func (e *configError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.problems, "\n  - ")
+}
+
+// validate returns the problems found in the configuration.
+func (c *config) validate() []string {
+	problems := []string{}
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		add("port: %d is not a valid port", c.Port)
+	}
+	if c.DebugPort < 0 || c.DebugPort > 65535 {
+		add("debug_port: %d is not a valid port", c.DebugPort)
+	}
+	if c.DebugPort != 0 && c.DebugPort == c.Port {
+		add("debug_port: cannot be the same as port")
+	}
+	if c.HTTPPort < 0 || c.HTTPPort > 65535 {
+		add("http_port: %d is not a valid port", c.HTTPPort)
+	}
+	if c.HTTPPort != 0 && (c.HTTPPort == c.Port || c.HTTPPort == c.DebugPort) {
+		add("http_port: cannot be the same as port or debug_port")
+	}
+	if c.DAVPrefix != "" {
+		switch strings.TrimSuffix(c.DAVPrefix, "/") {
+		case "", "/records", "/list", "/mv":
+			add("dav_prefix: %q is used by the gateway", c.DAVPrefix)
+		}
+		if !strings.HasPrefix(c.DAVPrefix, "/") {
+			add("dav_prefix: must start with /")
+		}
+		if c.HTTPPort == 0 {
+			add("dav_prefix: needs http_port")
+		}
+	}
+	if c.DSN == "" {
+		add("dsn: is required")
+	}
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		add("log_level: %s", err)
+	}
+	if c.MaxSQLIdle < 0 {
+		add("max_sql_idle: cannot be negative")
+	}
+	if c.MaxSQLConcurrency < 0 {
+		add("max_sql_concurrency: cannot be negative")
+	}
+	if c.MaxSQLConcurrency > 0 && c.MaxSQLIdle > c.MaxSQLConcurrency {
+		add("max_sql_idle: cannot be greater than max_sql_concurrency")
+	}
+
+	if _, err := newPathPolicy(c.Normalization, c.CaseInsensitive); err != nil {
+		add("normalization: %s", err)
+	}
+	if c.HomeDepth < 1 {
+		add("home_depth: must be at least 1")
+	}
+	if c.Layout != layoutPath && c.Layout != layoutTree {
+		add("layout: %q is not %s or %s", c.Layout, layoutPath, layoutTree)
+	}
+	if c.RecordCacheSize < 0 {
+		add("record_cache_size: cannot be negative")
+	}
+	// records changed through other instances are only seen once
+	// they expire, so they must
+	if c.RecordCacheTTL <= 0 {
+		add("record_cache_ttl: must be positive")
+	}
+	if len(c.ReplicaDSNs) > 0 && c.Layout == layoutTree {
+		add("replica_dsns: not supported with the tree layout")
+	}
+	if c.ReadYourWritesWindow < 0 {
+		add("read_your_writes_window: cannot be negative")
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		add("tls_cert, tls_key: both must be set to enable TLS")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		add("tls_client_ca: needs tls_cert and tls_key")
+	}
+	for _, f := range []string{c.TLSCert, c.TLSKey, c.TLSClientCA, c.JWKS} {
+		if _, err := os.Stat(f); f != "" && err != nil {
+			add("%s", err)
+		}
+	}
+
+	for _, alg := range c.JWTAlgorithms {
+		if jwt.GetSigningMethod(alg) == nil {
+			add("jwt_algorithms: unknown algorithm %q", alg)
+		}
+		if isHMAC(alg) && c.SharedSecret == "" {
+			add("jwt_algorithms: %s needs shared_secret", alg)
+		}
+	}
+	if len(c.JWTAlgorithms) == 0 && len(c.JWTPublicKeys) == 0 && c.JWKS == "" && c.SharedSecret == "" {
+		add("shared_secret: is required when no public keys are set")
+	}
+	for kid, f := range c.JWTPublicKeys {
+		if _, err := os.Stat(f); err != nil {
+			add("jwt_public_keys: %s: %s", kid, err)
+		}
+	}
+	if c.TokenCacheSize < 0 {
+		add("token_cache_size: cannot be negative")
+	}
+
+	for method, l := range c.RateLimits {
+		if l.Rate < 0 || l.Burst < 0 || l.MaxInFlight < 0 {
+			add("rate_limits: %s: values cannot be negative", method)
+		}
+	}
+	for method, d := range c.Timeouts {
+		if d <= 0 {
+			add("timeouts: %s: must be positive", method)
+		}
+	}
+
+	return problems
+}
+
+// dsnPassword matches the password of a MySQL DSN, user:password@...
+var dsnPassword = regexp.MustCompile(`^([^:@/]*):[^@]*@`)
+
+// redacted returns a copy of the configuration without the secrets.
+func (c *config) redacted() *config {
+	r := *c
+	if r.SharedSecret != "" {
+		r.SharedSecret = redacted
+	}
+	r.DSN = dsnPassword.ReplaceAllString(r.DSN, "${1}:"+redacted+"@")
+	r.ReplicaDSNs = nil
+	for _, dsn := range c.ReplicaDSNs {
+		r.ReplicaDSNs = append(r.ReplicaDSNs, dsnPassword.ReplaceAllString(dsn, "${1}:"+redacted+"@"))
+	}
+	return &r
+}
+
+// redactedYAML returns the configuration as YAML with the secrets redacted.
+func (c *config) redactedYAML() (string, error) {
+	data, err := yaml.Marshal(c.redacted())
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// printConfig logs the effective configuration, one setting per line.
+func printConfig(c *config) {
+	out, err := c.redactedYAML()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		log.Info(line)
+	}
+}
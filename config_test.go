@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns the default configuration with the required
+// settings set.
+func validConfig() *config {
+	c := defaultConfig()
+	c.DSN = "user:pass@tcp(localhost:3306)/prop"
+	c.SharedSecret = testSharedSecret
+	return c
+}
+
+func TestConfigValidate(t *testing.T) {
+	if problems := validConfig().validate(); len(problems) != 0 {
+		t.Fatalf("default configuration: %v", problems)
+	}
+
+	tests := []struct {
+		name    string
+		change  func(c *config)
+		problem string
+	}{
+		{"port", func(c *config) { c.Port = 0 }, "port:"},
+		{"debug port", func(c *config) { c.DebugPort = c.Port }, "debug_port:"},
+		{"http port", func(c *config) { c.HTTPPort = c.Port }, "http_port:"},
+		{"dav prefix of the gateway", func(c *config) { c.HTTPPort = 8080; c.DAVPrefix = "/records" }, "dav_prefix:"},
+		{"dav prefix without gateway", func(c *config) { c.DAVPrefix = "/dav" }, "dav_prefix:"},
+		{"dsn", func(c *config) { c.DSN = "" }, "dsn:"},
+		{"log level", func(c *config) { c.LogLevel = "loud" }, "log_level:"},
+		{"idle over open", func(c *config) { c.MaxSQLIdle, c.MaxSQLConcurrency = 10, 5 }, "max_sql_idle:"},
+		{"normalization", func(c *config) { c.Normalization = "nfx" }, "normalization:"},
+		{"home depth", func(c *config) { c.HomeDepth = 0 }, "home_depth:"},
+		{"layout", func(c *config) { c.Layout = "flat" }, "layout:"},
+		{"record cache ttl", func(c *config) { c.RecordCacheTTL = -time.Second }, "record_cache_ttl:"},
+		{"record cache without expiry", func(c *config) { c.RecordCacheTTL = 0 }, "record_cache_ttl:"},
+		{"replicas with the tree layout", func(c *config) { c.Layout = layoutTree; c.ReplicaDSNs = []string{"r"} }, "replica_dsns:"},
+		{"tls client ca without cert", func(c *config) { c.TLSClientCA = os.DevNull }, "tls_client_ca:"},
+		{"missing jwks", func(c *config) { c.JWKS = "/nonexistent/jwks.json" }, "stat /nonexistent/jwks.json"},
+		{"unknown algorithm", func(c *config) { c.JWTAlgorithms = []string{"XX256"} }, "jwt_algorithms:"},
+		{"hmac without secret", func(c *config) { c.SharedSecret = ""; c.JWTAlgorithms = []string{"HS256"} }, "jwt_algorithms:"},
+		{"no key", func(c *config) { c.SharedSecret = "" }, "shared_secret:"},
+		{"token cache size", func(c *config) { c.TokenCacheSize = -1 }, "token_cache_size:"},
+		{"rate limit", func(c *config) { c.RateLimits = map[string]methodLimits{"get": {Rate: -1}} }, "rate_limits:"},
+		{"timeout", func(c *config) { c.Timeouts = map[string]time.Duration{"get": 0} }, "timeouts:"},
+	}
+	for _, tt := range tests {
+		c := validConfig()
+		tt.change(c)
+		problems := c.validate()
+		if len(problems) != 1 || !strings.HasPrefix(problems[0], tt.problem) {
+			t.Errorf("%s: problems %q, want one starting with %q", tt.name, problems, tt.problem)
+		}
+	}
+
+	// all the problems are reported at once
+	c := validConfig()
+	c.Port, c.DSN, c.HomeDepth = 0, "", 0
+	if problems := c.validate(); len(problems) != 3 {
+		t.Errorf("problems %q, want 3", problems)
+	}
+}
+
+// loadConfig loads the configuration from the file with content yaml,
+// if any, and from args as the command line.
+func loadConfig(t *testing.T, yaml string, args ...string) (*config, error) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cf := newConfigFlags(fs)
+	if yaml != "" {
+		file := filepath.Join(dir, "config.yaml")
+		if err := ioutil.WriteFile(file, []byte(yaml), 0600); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", file}, args...)
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cf.load()
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	for _, s := range settings {
+		t.Setenv(s.envar, "")
+	}
+	t.Setenv(configEnvar, "")
+
+	yaml := `
+dsn: file@/prop
+shared_secret: file-secret
+port: 1000
+log_level: info
+timeouts:
+  get: 1s
+`
+	t.Setenv(portEnvar, "2000")
+	t.Setenv(dsnEnvar, "env@/prop")
+	t.Setenv(timeoutsEnvar, "*=5s")
+
+	c, err := loadConfig(t, yaml, "-port", "3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flag over environment over file over default
+	if c.Port != 3000 {
+		t.Errorf("port %d, want the flag 3000", c.Port)
+	}
+	if c.DSN != "env@/prop" {
+		t.Errorf("dsn %q, want the environment one", c.DSN)
+	}
+	if c.LogLevel != "info" || c.SharedSecret != "file-secret" {
+		t.Errorf("log level %q and secret %q, want the file ones", c.LogLevel, c.SharedSecret)
+	}
+	if c.Layout != layoutPath {
+		t.Errorf("layout %q, want the default", c.Layout)
+	}
+	// maps are replaced, not merged
+	if len(c.Timeouts) != 1 || c.Timeouts[defaultLimitsKey] != 5*time.Second {
+		t.Errorf("timeouts %v, want only the environment ones", c.Timeouts)
+	}
+
+	// a flag overrides the file as well
+	if c, err = loadConfig(t, yaml, "-log-level", "warn"); err != nil {
+		t.Fatal(err)
+	}
+	if c.LogLevel != "warn" {
+		t.Errorf("log level %q, want the flag", c.LogLevel)
+	}
+}
+
+func TestConfigLoadErrors(t *testing.T) {
+	for _, s := range settings {
+		t.Setenv(s.envar, "")
+	}
+	t.Setenv(configEnvar, "")
+
+	if _, err := loadConfig(t, "dsn: x@/prop\nshared_secret: s\nprot: 1\n"); err == nil || !strings.Contains(err.Error(), "prot") {
+		t.Errorf("unknown key: %v", err)
+	}
+
+	t.Setenv(portEnvar, "http")
+	_, err := loadConfig(t, "", "-home-depth", "many")
+	cerr, ok := err.(*configError)
+	if !ok {
+		t.Fatalf("error %v, want a configuration error", err)
+	}
+	// the unparsable values and the missing settings at once
+	want := []string{portEnvar + ":", "-home-depth:", "dsn:", "shared_secret:"}
+	if len(cerr.problems) != len(want) {
+		t.Fatalf("problems %q, want %d", cerr.problems, len(want))
+	}
+	for i, p := range want {
+		if !strings.HasPrefix(cerr.problems[i], p) {
+			t.Errorf("problem %q, want one starting with %q", cerr.problems[i], p)
+		}
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	c := validConfig()
+	c.ReplicaDSNs = []string{"reader:hunter2@tcp(replica:3306)/prop"}
+	out, err := c.redactedYAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{testSharedSecret, "pass", "hunter2"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%q in the printed configuration:\n%s", secret, out)
+		}
+	}
+	if c.SharedSecret != testSharedSecret || !strings.Contains(c.DSN, "pass") {
+		t.Error("configuration changed by redacting it")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	stdcontext "context"
+	"database/sql/driver"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	metadata "google.golang.org/grpc/metadata"
+	"net"
+)
+
+// Error reasons are sent to the client in the trailer under reasonKey.
+// They are part of the API: clients branch on them instead of parsing
+// error messages, so existing values must never change.
+const (
+	reasonKey     = "error-reason"
+	pathKey       = "error-path"
+	retryAfterKey = "retry-after"
+
+	reasonNotFound            = "RECORD_NOT_FOUND"
+	reasonAlreadyExists       = "RECORD_ALREADY_EXISTS"
+	reasonCaseCollision       = "CASE_COLLISION"
+	reasonPreconditionFailed  = "PRECONDITION_FAILED"
+	reasonInvalidPath         = "INVALID_PATH"
+	reasonDatabaseUnavailable = "DATABASE_UNAVAILABLE"
+	reasonTimeout             = "TIMEOUT"
+	reasonCanceled            = "CANCELED"
+	reasonRateLimited         = "RATE_LIMITED"
+	reasonInvalidArchive      = "INVALID_ARCHIVE"
+	reasonInternal            = "INTERNAL"
+)
+
+// MySQL server error numbers we map to specific codes.
+// See https://dev.mysql.com/doc/refman/5.7/en/error-messages-server.html
+const (
+	mysqlErrTooManyConnections = 1040
+	mysqlErrDupEntry           = 1062
+	mysqlErrLockWaitTimeout    = 1205
+	mysqlErrDeadlock           = 1213
+	mysqlErrDataTooLong        = 1406
+	mysqlErrQueryTimeout       = 3024
+)
+
+// newGRPCError returns a gRPC error with the given code and
+// sets the stable reason and the affected path in the trailer.
+func newGRPCError(ctx context.Context, code codes.Code, reason, p, format string, a ...interface{}) error {
+	return newGRPCErrorWithMD(ctx, nil, code, reason, p, format, a...)
+}
+
+// newGRPCErrorWithMD is like newGRPCError but also sends extra in
+// the trailer, as it can only be set once.
+func newGRPCErrorWithMD(ctx context.Context, extra metadata.MD, code codes.Code, reason, p, format string, a ...interface{}) error {
+	md := metadata.Pairs(reasonKey, reason)
+	for k, v := range extra {
+		md[k] = v
+	}
+	if p != "" {
+		// Pairs encodes non ASCII paths as binary headers
+		for k, v := range metadata.Pairs(pathKey, p) {
+			md[k] = v
+		}
+	}
+
+	if t, ok := ctx.Value(trailerCaptureKey{}).(*metadata.MD); ok && *t == nil {
+		*t = md
+	}
+
+	if err := grpc.SetTrailer(ctx, md); err != nil {
+		// the trailer can only be set once per stream and a nested
+		// handler may have set it already, or the context does not
+		// belong to a gRPC stream at all.
+		rus.Debug(err)
+	}
+
+	return grpc.Errorf(code, format, a...)
+}
+
+type trailerCaptureKey struct{}
+
+// withTrailerCapture returns a context in which the trailer set by
+// newGRPCError is also stored in the returned MD. It is used when
+// handlers are called outside of a gRPC stream, like the gateway does.
+func withTrailerCapture(ctx context.Context) (context.Context, *metadata.MD) {
+	var t metadata.MD
+	return context.WithValue(ctx, trailerCaptureKey{}, &t), &t
+}
+
+// toGRPCError maps database and domain errors to gRPC errors.
+// Errors that are already gRPC errors are returned untouched.
+func toGRPCError(ctx context.Context, err error, p string) error {
+	if err == nil {
+		return nil
+	}
+
+	if grpc.Code(err) != codes.Unknown {
+		return err
+	}
+
+	// whatever the database returned, the request ran out of time
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return newGRPCError(ctx, codes.DeadlineExceeded, reasonTimeout, p, "deadline exceeded")
+	case context.Canceled:
+		return newGRPCError(ctx, codes.Canceled, reasonCanceled, p, "request canceled")
+	}
+
+	switch err {
+	case gorm.RecordNotFound:
+		return newGRPCError(ctx, codes.NotFound, reasonNotFound, p, "record not found")
+	case context.DeadlineExceeded, stdcontext.DeadlineExceeded:
+		return newGRPCError(ctx, codes.DeadlineExceeded, reasonTimeout, p, "deadline exceeded")
+	case context.Canceled, stdcontext.Canceled:
+		return newGRPCError(ctx, codes.Canceled, reasonCanceled, p, "request canceled")
+	case driver.ErrBadConn, mysql.ErrInvalidConn:
+		return newGRPCError(ctx, codes.Unavailable, reasonDatabaseUnavailable, p, "database unavailable")
+	}
+
+	switch e := err.(type) {
+	case *pathError:
+		// the offending path is not echoed back as it
+		// may contain bytes not allowed in metadata.
+		return newGRPCError(ctx, codes.InvalidArgument, reasonInvalidPath, "", "%s", e)
+	case *mysql.MySQLError:
+		switch e.Number {
+		case mysqlErrDupEntry:
+			return newGRPCError(ctx, codes.AlreadyExists, reasonAlreadyExists, p, "record already exists")
+		case mysqlErrDataTooLong:
+			return newGRPCError(ctx, codes.InvalidArgument, reasonInvalidPath, p, "path too long")
+		case mysqlErrLockWaitTimeout, mysqlErrQueryTimeout:
+			return newGRPCError(ctx, codes.DeadlineExceeded, reasonTimeout, p, "database timeout")
+		case mysqlErrDeadlock:
+			return newGRPCError(ctx, codes.Aborted, reasonPreconditionFailed, p, "concurrent modification, retry")
+		case mysqlErrTooManyConnections:
+			return newGRPCError(ctx, codes.Unavailable, reasonDatabaseUnavailable, p, "database unavailable")
+		}
+	case net.Error:
+		if e.Timeout() {
+			return newGRPCError(ctx, codes.DeadlineExceeded, reasonTimeout, p, "database timeout")
+		}
+		return newGRPCError(ctx, codes.Unavailable, reasonDatabaseUnavailable, p, "database unavailable")
+	}
+
+	// do not leak internal details like SQL to the client,
+	// the original error is logged by the caller.
+	return newGRPCError(ctx, codes.Internal, reasonInternal, p, "internal error")
+}
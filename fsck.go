@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/nu7hatch/gouuid"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// fsckReport lists the violations of the propagation invariants.
+type fsckReport struct {
+	homes      int
+	staleMTime []string
+	orphaned   []string
+	duplicates []string
+	repaired   int
+}
+
+func (r *fsckReport) print(w io.Writer, repair bool) {
+	for _, v := range r.staleMTime {
+		fmt.Fprintf(w, "stale-mtime  %s\n", v)
+	}
+	for _, v := range r.orphaned {
+		fmt.Fprintf(w, "orphaned     %s\n", v)
+	}
+	for _, v := range r.duplicates {
+		fmt.Fprintf(w, "duplicate-id %s\n", v)
+	}
+
+	fmt.Fprintf(w, "%d homes checked: %d stale mtimes, %d orphaned paths, %d duplicate ids\n",
+		r.homes, len(r.staleMTime), len(r.orphaned), len(r.duplicates))
+	if repair {
+		fmt.Fprintf(w, "%d records repaired\n", r.repaired)
+	} else if len(r.staleMTime)+len(r.orphaned)+len(r.duplicates) > 0 {
+		fmt.Fprintln(w, "run with -repair to fix them")
+	}
+}
+
+func (r *fsckReport) clean() bool {
+	return len(r.staleMTime)+len(r.orphaned)+len(r.duplicates) == 0
+}
+
+func fsckCommand(args []string) error {
+	fs, cf := newCommandFlags("fsck", "[-prefix <path>] [-repair]")
+	prefix := fs.String("prefix", "/", "only check the homes under this path")
+	repair := fs.Bool("repair", false, "repair the violations found")
+	fs.Parse(args)
+
+	s, err := newCommandServer(cf)
+	if err != nil {
+		return err
+	}
+
+	report, err := s.fsck(context.Background(), *prefix, *repair)
+	if err != nil {
+		return err
+	}
+	report.print(os.Stdout, *repair)
+	if !*repair && !report.clean() {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// fsck checks the records of every home under prefix:
+//   - every record is at least as new as its newest descendant,
+//     which propagateChanges may fail to ensure as it stops early and
+//     its errors are only logged;
+//   - every record below a home has a parent record;
+//   - no two records share an ID.
+//
+// With repair, missing parents are created, stale records get the
+// mtime of their newest descendant and a new ETag, and all but the
+// first record of a duplicated ID, by path, get a new ID.
+//
+// In the tree layout only the mtimes are checked: placeholders stand
+// for the missing parents and IDs are the primary key of the nodes.
+func (s *server) fsck(ctx context.Context, prefix string, repair bool) (*fsckReport, error) {
+
+	traceID, err := getGRPCTraceID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
+	ctx = newGRPCTraceContext(ctx, traceID)
+
+	prefix, err = s.paths.canonical(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	homes, err := s.getHomes(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &fsckReport{}
+	for _, home := range homes {
+		log.Infof("checking home %s", home)
+		if err := s.fsckHome(ctx, home, repair, report); err != nil {
+			return nil, err
+		}
+		report.homes++
+	}
+
+	if s.tree {
+		return report, nil
+	}
+	if err := s.fsckIDs(ctx, repair, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// getHomes returns the home directories holding records under prefix.
+func (s *server) getHomes(ctx context.Context, prefix string) ([]string, error) {
+
+	if s.tree {
+		return s.treeGetHomes(ctx, prefix)
+	}
+
+	homeDepth := s.getRuntime().homeDepth
+	rows, err := s.db.DB().QueryContext(ctx,
+		"SELECT DISTINCT SUBSTRING_INDEX(path, '/', ?) FROM records WHERE path=? OR path LIKE ? ESCAPE '"+likeEscape+"'",
+		homeDepth+1, prefix, likePrefix(strings.TrimSuffix(prefix, "/")+"/"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	homes := []string{}
+	for rows.Next() {
+		var home string
+		if err := rows.Scan(&home); err != nil {
+			return nil, err
+		}
+		// records above the homes are not propagated to
+		if strings.Count(home, "/") == homeDepth {
+			homes = append(homes, home)
+		}
+	}
+	sort.Strings(homes)
+	return homes, rows.Err()
+}
+
+func (s *server) fsckHome(ctx context.Context, home string, repair bool, report *fsckReport) error {
+
+	recs, err := s.getDescendants(ctx, home)
+	if err != nil {
+		return err
+	}
+	rec, err := s.getByPath(ctx, home)
+	if err != nil && err != gorm.RecordNotFound {
+		return err
+	}
+	if err == nil {
+		recs = append(recs, *rec)
+	}
+
+	byKey := map[string]*record{}
+	for i := range recs {
+		byKey[s.pathKey(recs[i].Path)] = &recs[i]
+	}
+
+	// newest mtime under each path, records or not
+	newest := map[string]uint32{}
+	// paths missing a record by key
+	missing := map[string]string{}
+
+	for _, r := range recs {
+		// every ancestor up to the home must have a record
+		for p := r.Path; p != home && p != "/"; {
+			p = path.Dir(p)
+			key := s.pathKey(p)
+			if newest[key] < r.MTime {
+				newest[key] = r.MTime
+			}
+			if _, ok := byKey[key]; !ok && !s.tree {
+				if _, reported := missing[key]; !reported {
+					report.orphaned = append(report.orphaned, fmt.Sprintf("%s: no record for parent %s", r.Path, p))
+					missing[key] = p
+				}
+			}
+		}
+	}
+
+	stale := []*record{}
+	for _, r := range recs {
+		if m := newest[s.pathKey(r.Path)]; r.MTime < m {
+			report.staleMTime = append(report.staleMTime, fmt.Sprintf("%s: mtime %d older than descendant mtime %d", r.Path, r.MTime, m))
+			stale = append(stale, byKey[s.pathKey(r.Path)])
+		}
+	}
+
+	if !repair {
+		return nil
+	}
+
+	for key, p := range missing {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		etag, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		// as new as its newest descendant to satisfy the invariant
+		if err := s.insert(ctx, id.String(), p, s.paths.fold(p), "", etag.String(), newest[key]); err != nil {
+			return err
+		}
+		report.repaired++
+	}
+
+	for _, r := range stale {
+		etag, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		m := newest[s.pathKey(r.Path)]
+		// a newer change made in the meanwhile is kept
+		if s.tree {
+			_, err = s.db.DB().ExecContext(ctx, "UPDATE nodes SET e_tag=?, m_time=? WHERE id=? AND m_time < ?",
+				etag.String(), m, r.ID, m)
+		} else {
+			_, err = s.db.DB().ExecContext(ctx, "UPDATE records SET e_tag=?, m_time=? WHERE id=? AND path=? AND m_time < ?",
+				etag.String(), m, r.ID, r.Path, m)
+		}
+		if err != nil {
+			return err
+		}
+		report.repaired++
+	}
+	return nil
+}
+
+// fsckIDs looks for records sharing an ID.
+func (s *server) fsckIDs(ctx context.Context, repair bool, report *fsckReport) error {
+
+	rows, err := s.db.DB().QueryContext(ctx, "SELECT id FROM records GROUP BY id HAVING COUNT(*) > 1")
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		recs, err := queryRecords(ctx, s.db.DB(), "id=? ORDER BY path", id)
+		if err != nil {
+			return err
+		}
+
+		paths := []string{}
+		for _, r := range recs {
+			paths = append(paths, r.Path)
+		}
+		report.duplicates = append(report.duplicates, fmt.Sprintf("%s: %s", id, strings.Join(paths, ", ")))
+
+		if !repair {
+			continue
+		}
+		for _, r := range recs[1:] {
+			newID, err := uuid.NewV4()
+			if err != nil {
+				return err
+			}
+			_, err = s.db.DB().ExecContext(ctx, "UPDATE records SET id=? WHERE id=? AND path=?", newID.String(), id, r.Path)
+			if err != nil {
+				return err
+			}
+			report.repaired++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	metadata "google.golang.org/grpc/metadata"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// traceHeader carries the trace ID of HTTP requests and responses.
+	traceHeader = "X-Trace-Id"
+
+	// maxGatewayBody is the maximum size of a request body.
+	maxGatewayBody = 1 << 20
+)
+
+// gateway exposes the RPCs as HTTP/JSON endpoints:
+//
+//	GET    /records/{path}[?force=true]  Get, force creates the record if missing
+//	PUT    /records/{path}               Put, with an optional {"checksum": ""} body
+//	DELETE /records/{path}               Rm
+//	GET    /list/{path}[?recursive=true] List
+//	POST   /mv                           Mv, with a {"src": "", "dst": ""} body
+//
+// Requests go through the same handlers as gRPC ones, so
+// authentication, limits and timeouts apply the same way.
+type gateway struct {
+	srv pb.PropServer
+}
+
+// newGateway returns the handler of the gateway. If davPrefix is not
+// empty PROPFIND requests are also answered under it.
+func newGateway(srv pb.PropServer, davPrefix string) http.Handler {
+	g := &gateway{srv: srv}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/records/", g.records)
+	mux.HandleFunc("/list/", g.list)
+	mux.HandleFunc("/mv", g.mv)
+	if davPrefix != "" {
+		davPrefix = strings.TrimSuffix(davPrefix, "/")
+		mux.HandleFunc(davPrefix+"/", g.dav(davPrefix))
+	}
+	return mux
+}
+
+// context returns the context of an RPC for r, carrying the
+// authorization and trace metadata, and the trailer it sets.
+func (g *gateway) context(w http.ResponseWriter, r *http.Request) (context.Context, *metadata.MD) {
+	md := metadata.MD{}
+	if v := r.Header.Get("Authorization"); v != "" {
+		md[authorizationKey] = []string{v}
+	}
+	if v := r.Header.Get(traceHeader); v != "" {
+		md["trace"] = []string{v}
+	}
+	ctx := metadata.NewContext(r.Context(), md)
+
+	// resolve the trace ID here to send it back
+	traceID, err := getGRPCTraceID(ctx)
+	if err == nil {
+		ctx = newGRPCTraceContext(ctx, traceID)
+		w.Header().Set(traceHeader, traceID)
+	}
+
+	return withTrailerCapture(ctx)
+}
+
+func (g *gateway) records(w http.ResponseWriter, r *http.Request) {
+	ctx, trailer := g.context(w, r)
+	p := "/" + strings.TrimPrefix(r.URL.Path, "/records/")
+
+	switch r.Method {
+	case "GET", "HEAD":
+		force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+		rec, err := g.srv.Get(ctx, &pb.GetReq{Path: p, ForceCreation: force})
+		if err != nil {
+			writeGatewayError(w, err, *trailer)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+
+	case "PUT":
+		req := &pb.PutReq{}
+		if !readJSON(w, r, req) {
+			return
+		}
+		req.AccessToken = ""
+		req.Path = p
+		if _, err := g.srv.Put(ctx, req); err != nil {
+			writeGatewayError(w, err, *trailer)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		if _, err := g.srv.Rm(ctx, &pb.RmReq{Path: p}); err != nil {
+			writeGatewayError(w, err, *trailer)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (g *gateway) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, trailer := g.context(w, r)
+	p := "/" + strings.TrimPrefix(r.URL.Path, "/list/")
+	recursive, _ := strconv.ParseBool(r.URL.Query().Get("recursive"))
+
+	res, err := g.srv.List(ctx, &pb.ListReq{Path: p, Recursive: recursive})
+	if err != nil {
+		writeGatewayError(w, err, *trailer)
+		return
+	}
+	if res.Records == nil {
+		// an empty list rather than null
+		res.Records = []*pb.Record{}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (g *gateway) mv(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, trailer := g.context(w, r)
+	req := &pb.MvReq{}
+	if !readJSON(w, r, req) {
+		return
+	}
+	// tokens only come in the authorization header
+	req.AccessToken = ""
+
+	if _, err := g.srv.Mv(ctx, req); err != nil {
+		writeGatewayError(w, err, *trailer)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readJSON decodes the body of r, which may be empty, into v. It writes
+// the error response and returns false if the body is not valid.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body := http.MaxBytesReader(w, r.Body, maxGatewayBody)
+	err := json.NewDecoder(body).Decode(v)
+	if err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, &gatewayError{
+			Code:    codes.InvalidArgument.String(),
+			Message: "invalid JSON body: " + err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		rus.Error(err)
+	}
+}
+
+// gatewayError is the body of error responses.
+type gatewayError struct {
+	Code    string `json:"code"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message"`
+	Path    string `json:"path,omitempty"`
+}
+
+func writeGatewayError(w http.ResponseWriter, err error, trailer metadata.MD) {
+	trailer = decodeTrailer(trailer)
+	code := grpc.Code(err)
+	e := &gatewayError{}
+	e.Code = code.String()
+	e.Message = grpc.ErrorDesc(err)
+	if v := trailer[reasonKey]; len(v) > 0 {
+		e.Reason = v[0]
+	}
+	if v := trailer[pathKey]; len(v) > 0 {
+		e.Path = v[0]
+	}
+	if v := trailer[retryAfterKey]; len(v) > 0 {
+		w.Header().Set("Retry-After", v[0])
+	}
+	if code == codes.Unauthenticated {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	writeJSON(w, httpStatus(code), e)
+}
+
+// decodeTrailer returns the captured trailer with the values sent as
+// binary headers, like non ASCII paths, decoded under their key as the
+// gRPC transport does for remote clients.
+func decodeTrailer(trailer metadata.MD) metadata.MD {
+	md := metadata.MD{}
+	for k, vs := range trailer {
+		for _, v := range vs {
+			key, val, err := metadata.DecodeKeyValue(k, v)
+			if err != nil {
+				rus.Error(err)
+				continue
+			}
+			md[key] = append(md[key], val)
+		}
+	}
+	return md
+}
+
+// httpStatus maps a gRPC status code to an HTTP status code.
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		// as nginx does for clients closing the connection
+		return 499
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		code   codes.Code
+		status int
+	}{
+		{codes.OK, http.StatusOK},
+		{codes.Canceled, 499},
+		{codes.InvalidArgument, http.StatusBadRequest},
+		{codes.OutOfRange, http.StatusBadRequest},
+		{codes.DeadlineExceeded, http.StatusGatewayTimeout},
+		{codes.NotFound, http.StatusNotFound},
+		{codes.AlreadyExists, http.StatusConflict},
+		{codes.Aborted, http.StatusConflict},
+		{codes.PermissionDenied, http.StatusForbidden},
+		{codes.Unauthenticated, http.StatusUnauthorized},
+		{codes.ResourceExhausted, http.StatusTooManyRequests},
+		{codes.FailedPrecondition, http.StatusPreconditionFailed},
+		{codes.Unimplemented, http.StatusNotImplemented},
+		{codes.Unavailable, http.StatusServiceUnavailable},
+		{codes.Internal, http.StatusInternalServerError},
+		{codes.Unknown, http.StatusInternalServerError},
+		{codes.DataLoss, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if status := httpStatus(tt.code); status != tt.status {
+			t.Errorf("httpStatus(%s) = %d, want %d", tt.code, status, tt.status)
+		}
+	}
+}
+
+// TestWriteGatewayError writes the errors of newGRPCError as the
+// gateway does, with the trailer it captures.
+func TestWriteGatewayError(t *testing.T) {
+	tests := []struct {
+		code       codes.Code
+		reason     string
+		path       string
+		status     int
+		retryAfter string
+		challenge  string
+	}{
+		{codes.NotFound, reasonNotFound, "/local/users/d/demo/a", http.StatusNotFound, "", ""},
+		// sent as a binary header, base64 encoded
+		{codes.AlreadyExists, reasonCaseCollision, "/local/users/d/demo/Café", http.StatusConflict, "", ""},
+		{codes.InvalidArgument, reasonInvalidPath, "", http.StatusBadRequest, "", ""},
+		{codes.ResourceExhausted, reasonRateLimited, "", http.StatusTooManyRequests, "2", ""},
+		{codes.Unauthenticated, "", "", http.StatusUnauthorized, "", "Bearer"},
+	}
+	for _, tt := range tests {
+		ctx, trailer := withTrailerCapture(context.Background())
+		var err error
+		if tt.retryAfter != "" {
+			err = newGRPCErrorWithMD(ctx, map[string][]string{retryAfterKey: {tt.retryAfter}}, tt.code, tt.reason, tt.path, "failed")
+		} else {
+			err = newGRPCError(ctx, tt.code, tt.reason, tt.path, "failed")
+		}
+
+		w := httptest.NewRecorder()
+		writeGatewayError(w, err, *trailer)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.code, w.Code, tt.status)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: content type %q", tt.code, ct)
+		}
+		if v := w.Header().Get("Retry-After"); v != tt.retryAfter {
+			t.Errorf("%s: Retry-After %q, want %q", tt.code, v, tt.retryAfter)
+		}
+		if v := w.Header().Get("WWW-Authenticate"); v != tt.challenge {
+			t.Errorf("%s: WWW-Authenticate %q, want %q", tt.code, v, tt.challenge)
+		}
+
+		e := &gatewayError{}
+		if err := json.NewDecoder(w.Body).Decode(e); err != nil {
+			t.Fatal(err)
+		}
+		want := gatewayError{Code: tt.code.String(), Reason: tt.reason, Message: "failed", Path: tt.path}
+		if *e != want {
+			t.Errorf("body %+v, want %+v", *e, want)
+		}
+	}
+}
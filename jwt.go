@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/clawio/service-auth/lib"
+	"github.com/dgrijalva/jwt-go"
+	rus "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyCheckInterval is how often at most the key files are
+// checked for changes.
+const keyCheckInterval = 10 * time.Second
+
+var (
+	errTokenWithoutExpiry = errors.New("token has no expiration time")
+	errUnknownKey         = errors.New("no key to verify the token")
+)
+
+// tokenVerifier verifies access tokens and extracts their identity.
+// Only the configured algorithms are accepted, whatever the token
+// header claims. HMAC tokens are verified with the shared secret and
+// RSA and ECDSA tokens with the public key matching their kid.
+//
+// Verified tokens are cached until they expire, keyed by their hash,
+// so clients reusing a token do not pay the verification on every RPC.
+// The cache is dropped when the keys are reloaded.
+type tokenVerifier struct {
+	sharedSecret string
+	algs         []string
+	keys         *keySet
+
+	// cache is nil when caching is disabled
+	cache        *lru
+	cacheVersion uint64
+	cacheMu      sync.Mutex
+}
+
+// newTokenVerifier returns a verifier caching up to cacheSize tokens.
+func newTokenVerifier(sharedSecret string, algs []string, publicKeys map[string]string, jwksFile string, cacheSize int) (*tokenVerifier, error) {
+
+	keys, err := newKeySet(publicKeys, jwksFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// backwards compatible default: only tokens signed
+	// with the shared secret unless public keys are set.
+	if len(algs) == 0 {
+		if keys.empty() {
+			algs = []string{"HS256"}
+		} else {
+			algs = []string{"RS256", "ES256"}
+		}
+	}
+
+	for _, alg := range algs {
+		if jwt.GetSigningMethod(alg) == nil {
+			return nil, fmt.Errorf("unknown JWT algorithm %q", alg)
+		}
+		if isHMAC(alg) && sharedSecret == "" {
+			return nil, fmt.Errorf("JWT algorithm %s needs a shared secret", alg)
+		}
+	}
+
+	v := &tokenVerifier{}
+	v.sharedSecret = sharedSecret
+	v.algs = algs
+	v.keys = keys
+	if cacheSize > 0 {
+		v.cache = newLRU(cacheSize)
+		v.cacheVersion = keys.version()
+	}
+	return v, nil
+}
+
+func (v *tokenVerifier) verify(token string) (*lib.Identity, error) {
+
+	if v.cache == nil {
+		return v.parse(token)
+	}
+
+	// pick up rotated keys before trusting the cache
+	v.keys.maybeReload()
+	v.cacheMu.Lock()
+	if version := v.keys.version(); version != v.cacheVersion {
+		v.cache.purge()
+		v.cacheVersion = version
+	}
+	v.cacheMu.Unlock()
+
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	if idt, ok := v.cache.get(key); ok {
+		tokenCacheHitsCounter.Add(1)
+		return idt.(*lib.Identity), nil
+	}
+	tokenCacheMissesCounter.Add(1)
+
+	t, idt, err := v.parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	exp := t.Claims["exp"].(float64)
+	v.cache.add(key, idt, time.Unix(int64(exp), 0))
+	return idt, nil
+}
+
+func (v *tokenVerifier) parse(token string) (*lib.Identity, error) {
+	_, idt, err := v.parseToken(token)
+	return idt, err
+}
+
+func (v *tokenVerifier) parseToken(token string) (*jwt.Token, *lib.Identity, error) {
+
+	p := &jwt.Parser{ValidMethods: v.algs}
+	t, err := p.Parse(token, v.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// jwt-go only checks exp and nbf when present
+	if _, ok := t.Claims["exp"].(float64); !ok {
+		return nil, nil, errTokenWithoutExpiry
+	}
+
+	idt, err := identityFromClaims(t.Claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, idt, nil
+}
+
+// key returns the key to verify t with. The key type must match the
+// algorithm family so an RSA public key can never be used as an HMAC
+// secret.
+func (v *tokenVerifier) key(t *jwt.Token) (interface{}, error) {
+
+	alg := t.Method.Alg()
+	if isHMAC(alg) {
+		return []byte(v.sharedSecret), nil
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	key, err := v.keys.get(kid, alg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		if _, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	case strings.HasPrefix(alg, "ES"):
+		if _, ok := key.(*ecdsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("key %q cannot verify %s tokens", kid, alg)
+}
+
+func isHMAC(alg string) bool {
+	return strings.HasPrefix(alg, "HS")
+}
+
+// identityFromClaims mirrors the claims read by lib.ParseToken.
+func identityFromClaims(claims map[string]interface{}) (*lib.Identity, error) {
+
+	idt := &lib.Identity{}
+	for name, dst := range map[string]*string{
+		"pid":          &idt.Pid,
+		"idp":          &idt.Idp,
+		"display_name": &idt.DisplayName,
+		"email":        &idt.Email,
+	} {
+		v, ok := claims[name].(string)
+		if !ok {
+			return nil, fmt.Errorf("failed cast to string of %s:%v", name, claims[name])
+		}
+		*dst = v
+	}
+	return idt, nil
+}
+
+// keySet holds the public keys indexed by kid, read from PEM files
+// and from a JWKS file. The files are reloaded when they change so
+// keys can be rotated without a restart.
+type keySet struct {
+	pemFiles map[string]string
+	jwksFile string
+
+	mu         sync.RWMutex
+	keys       map[string]interface{}
+	modTime    time.Time
+	checked    time.Time
+	generation uint64
+}
+
+// parsePublicKeys parses a comma separated list of kid=file pairs.
+// When the kid is omitted the file name without extension is used.
+func parsePublicKeys(s string) map[string]string {
+	keys := map[string]string{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, file := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			kid, file = entry[:i], entry[i+1:]
+		} else {
+			kid = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		keys[kid] = file
+	}
+	return keys
+}
+
+// newKeySet loads the PEM encoded public keys, indexed by kid,
+// and the keys in the JWKS file.
+func newKeySet(publicKeys map[string]string, jwksFile string) (*keySet, error) {
+
+	ks := &keySet{pemFiles: map[string]string{}, jwksFile: jwksFile}
+	for kid, file := range publicKeys {
+		ks.pemFiles[kid] = file
+	}
+
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (ks *keySet) files() []string {
+	files := []string{}
+	for _, f := range ks.pemFiles {
+		files = append(files, f)
+	}
+	if ks.jwksFile != "" {
+		files = append(files, ks.jwksFile)
+	}
+	return files
+}
+
+func (ks *keySet) empty() bool {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return len(ks.keys) == 0
+}
+
+// version changes every time the keys are reloaded.
+func (ks *keySet) version() uint64 {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.generation
+}
+
+func (ks *keySet) reload() error {
+
+	modTime, err := latestModTime(ks.files())
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]interface{}{}
+	for kid, file := range ks.pemFiles {
+		key, err := readPublicKey(file)
+		if err != nil {
+			return err
+		}
+		keys[kid] = key
+	}
+
+	if ks.jwksFile != "" {
+		data, err := ioutil.ReadFile(ks.jwksFile)
+		if err != nil {
+			return err
+		}
+		jwks, err := parseJWKS(data)
+		if err != nil {
+			return fmt.Errorf("%s: %s", ks.jwksFile, err)
+		}
+		for kid, key := range jwks {
+			keys[kid] = key
+		}
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = keys
+	ks.modTime = modTime
+	ks.checked = time.Now()
+	ks.generation++
+	return nil
+}
+
+// maybeReload reloads the keys if the files changed. Errors are
+// logged and the previous keys kept.
+func (ks *keySet) maybeReload() {
+
+	if len(ks.files()) == 0 {
+		return
+	}
+
+	ks.mu.Lock()
+	if time.Since(ks.checked) < keyCheckInterval {
+		ks.mu.Unlock()
+		return
+	}
+	ks.checked = time.Now()
+	modTime := ks.modTime
+	ks.mu.Unlock()
+
+	latest, err := latestModTime(ks.files())
+	if err == nil && !latest.After(modTime) {
+		return
+	}
+	if err == nil {
+		err = ks.reload()
+	}
+	if err != nil {
+		rus.Errorf("keys not reloaded: %s", err)
+		return
+	}
+
+	rus.Infof("keys reloaded")
+}
+
+// get returns the key for kid. Tokens without kid are accepted
+// only when there is a single key, for issuers that do not set it.
+func (ks *keySet) get(kid, alg string) (interface{}, error) {
+
+	ks.maybeReload()
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if kid == "" {
+		if len(ks.keys) == 1 {
+			for _, key := range ks.keys {
+				return key, nil
+			}
+		}
+		return nil, errUnknownKey
+	}
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%s: kid %q", errUnknownKey, kid)
+	}
+	return key, nil
+}
+
+func readPublicKey(file string) (interface{}, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: not a PEM encoded RSA or ECDSA public key", file)
+}
+
+// jwk is a JSON Web Key as defined in RFC 7517.
+// Only the fields of RSA and EC public keys are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if k.Kid == "" {
+			return nil, errors.New("key without kid")
+		}
+
+		var key interface{}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = k.rsaKey()
+		case "EC":
+			key, err = k.ecKey()
+		default:
+			err = fmt.Errorf("unsupported key type %q", k.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("kid %q: %s", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k *jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func (k *jwk) ecKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+
+	x, err := decodeBigInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys are the private keys the tokens of the tests are signed
+// with, generated once per run.
+var testKeys struct {
+	rsa   *rsa.PrivateKey
+	rsa2  *rsa.PrivateKey
+	ecdsa *ecdsa.PrivateKey
+}
+
+func init() {
+	var err error
+	if testKeys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	if testKeys.rsa2, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	if testKeys.ecdsa, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		panic(err)
+	}
+}
+
+// writePublicKey writes the PEM encoding of pub to dir/name.
+func writePublicKey(tb testing.TB, dir, name string, pub interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	return file
+}
+
+// writeJWKS writes the RSA public keys by kid as a JWKS file and
+// moves its mtime forward so the change is seen.
+func writeJWKS(tb testing.TB, file string, keys map[string]*rsa.PublicKey, mtime time.Time) {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	for kid, pub := range keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// signToken returns a token of the test identity signed with key by
+// method, with the claims changed by claims and kid in its header.
+func signToken(tb testing.TB, method jwt.SigningMethod, key interface{}, kid string, claims map[string]interface{}) string {
+	t := jwt.New(method)
+	t.Claims["pid"] = "test"
+	t.Claims["idp"] = "localhost"
+	t.Claims["display_name"] = "Test"
+	t.Claims["email"] = "test@localhost"
+	t.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	for name, v := range claims {
+		if v == nil {
+			delete(t.Claims, name)
+			continue
+		}
+		t.Claims[name] = v
+	}
+	if kid != "" {
+		t.Header["kid"] = kid
+	}
+	token, err := t.SignedString(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return token
+}
+
+func TestTokenVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaFile := writePublicKey(t, dir, "rsa.pem", &testKeys.rsa.PublicKey)
+	ecFile := writePublicKey(t, dir, "ec.pem", &testKeys.ecdsa.PublicKey)
+	rsaPEM, err := ioutil.ReadFile(rsaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]string{"rsa": rsaFile, "ec": ecFile}
+
+	// the header and claims of an unsigned token
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"pid":"test","idp":"localhost","display_name":"Test","email":"test@localhost","exp":4102444800}`)) + "."
+
+	hour := time.Hour
+	tests := []struct {
+		name  string
+		algs  []string
+		token string
+		ok    bool
+	}{
+		{"hs256 with the shared secret", []string{"HS256"},
+			signToken(t, jwt.SigningMethodHS256, []byte(testSharedSecret), "", nil), true},
+		{"rs256 with its kid", nil,
+			signToken(t, jwt.SigningMethodRS256, testKeys.rsa, "rsa", nil), true},
+		{"es256 with its kid", nil,
+			signToken(t, jwt.SigningMethodES256, testKeys.ecdsa, "ec", nil), true},
+		{"hs256 signed with the rsa public key", []string{"RS256"},
+			signToken(t, jwt.SigningMethodHS256, rsaPEM, "rsa", nil), false},
+		{"hs256 signed with the rsa public key, hs256 allowed", []string{"HS256", "RS256"},
+			signToken(t, jwt.SigningMethodHS256, rsaPEM, "rsa", nil), false},
+		{"hs256 not among the algorithms", []string{"RS256", "ES256"},
+			signToken(t, jwt.SigningMethodHS256, []byte(testSharedSecret), "", nil), false},
+		{"alg none", []string{"HS256", "RS256"}, none, false},
+		{"rs256 with the kid of an ecdsa key", []string{"RS256", "ES256"},
+			signToken(t, jwt.SigningMethodRS256, testKeys.rsa, "ec", nil), false},
+		{"es256 with the kid of an rsa key", []string{"RS256", "ES256"},
+			signToken(t, jwt.SigningMethodES256, testKeys.ecdsa, "rsa", nil), false},
+		{"signed by another key", nil,
+			signToken(t, jwt.SigningMethodRS256, testKeys.rsa2, "rsa", nil), false},
+		{"unknown kid", nil,
+			signToken(t, jwt.SigningMethodRS256, testKeys.rsa, "other", nil), false},
+		{"no kid with several keys", nil,
+			signToken(t, jwt.SigningMethodRS256, testKeys.rsa, "", nil), false},
+		{"no exp", nil,
+			signToken(t, jwt.SigningMethodRS256, testKeys.rsa, "rsa", map[string]interface{}{"exp": nil}), false},
+		{"expired", nil,
+			signToken(t, jwt.SigningMethodRS256, testKeys.rsa, "rsa", map[string]interface{}{"exp": time.Now().Add(-hour).Unix()}), false},
+		{"nbf in the past", nil,
+			signToken(t, jwt.SigningMethodRS256, testKeys.rsa, "rsa", map[string]interface{}{"nbf": time.Now().Add(-hour).Unix()}), true},
+		{"nbf in the future", nil,
+			signToken(t, jwt.SigningMethodRS256, testKeys.rsa, "rsa", map[string]interface{}{"nbf": time.Now().Add(hour).Unix()}), false},
+		{"no pid", nil,
+			signToken(t, jwt.SigningMethodRS256, testKeys.rsa, "rsa", map[string]interface{}{"pid": nil}), false},
+	}
+	for _, tt := range tests {
+		for _, cacheSize := range []int{0, 10} {
+			v, err := newTokenVerifier(testSharedSecret, tt.algs, keys, "", cacheSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a cached token must be rejected as well
+			for i := 0; i < 2; i++ {
+				idt, err := v.verify(tt.token)
+				if ok := err == nil; ok != tt.ok {
+					t.Errorf("%s (cache of %d): verify: %v, want ok %t", tt.name, cacheSize, err, tt.ok)
+					break
+				}
+				if err == nil && idt.Pid != "test" {
+					t.Errorf("%s: pid %q, want test", tt.name, idt.Pid)
+				}
+			}
+		}
+	}
+}
+
+func TestTokenVerifierConfig(t *testing.T) {
+	if _, err := newTokenVerifier("", []string{"HS256"}, nil, "", 0); err == nil {
+		t.Error("HS256 without a shared secret accepted")
+	}
+	if _, err := newTokenVerifier(testSharedSecret, []string{"none"}, nil, "", 0); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+	v, err := newTokenVerifier(testSharedSecret, nil, nil, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(v.algs, ",") != "HS256" {
+		t.Errorf("algorithms without keys %v, want HS256", v.algs)
+	}
+}
+
+// TestTokenVerifierJWKSRotation rotates the key of a JWKS file and
+// checks the tokens cached under the previous key are dropped.
+func TestTokenVerifierJWKSRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "jwks.json")
+	mtime := time.Now().Add(-time.Hour)
+	writeJWKS(t, file, map[string]*rsa.PublicKey{"a": &testKeys.rsa.PublicKey}, mtime)
+
+	v, err := newTokenVerifier("", nil, nil, file, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := signToken(t, jwt.SigningMethodRS256, testKeys.rsa, "a", nil)
+	rotated := signToken(t, jwt.SigningMethodRS256, testKeys.rsa2, "b", nil)
+
+	if _, err := v.verify(old); err != nil {
+		t.Fatal(err)
+	}
+	if v.cache.len() != 1 {
+		t.Fatalf("%d tokens cached, want 1", v.cache.len())
+	}
+	if _, err := v.verify(rotated); err == nil {
+		t.Fatal("token of a key not published yet accepted")
+	}
+
+	writeJWKS(t, file, map[string]*rsa.PublicKey{"b": &testKeys.rsa2.PublicKey}, mtime.Add(time.Minute))
+	// the files are checked every keyCheckInterval at most
+	v.keys.mu.Lock()
+	v.keys.checked = time.Time{}
+	v.keys.mu.Unlock()
+
+	if _, err := v.verify(old); err == nil {
+		t.Fatal("cached token of a removed key accepted")
+	}
+	if _, err := v.verify(rotated); err != nil {
+		t.Fatalf("token of the new key: %v", err)
+	}
+}
+
+// TestTokenCache checks verified tokens are cached by their hash until
+// they expire and only when the cache is enabled.
+func TestTokenCache(t *testing.T) {
+	v, err := newTokenVerifier(testSharedSecret, nil, nil, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	token := signToken(t, jwt.SigningMethodHS256, []byte(testSharedSecret), "", map[string]interface{}{"exp": exp})
+
+	hits, misses := tokenCacheHitsCounter.Value(), tokenCacheMissesCounter.Value()
+	first, err := v.verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := v.verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("cached identity not returned")
+	}
+	if h, m := tokenCacheHitsCounter.Value()-hits, tokenCacheMissesCounter.Value()-misses; h != 1 || m != 1 {
+		t.Errorf("%d hits and %d misses, want 1 and 1", h, m)
+	}
+
+	// the token itself is a credential and is not kept as the key
+	sum := sha256.Sum256([]byte(token))
+	el, ok := v.cache.items[hex.EncodeToString(sum[:])]
+	if !ok {
+		t.Fatal("token not cached under its hash")
+	}
+	if _, ok := v.cache.items[token]; ok {
+		t.Error("token cached under itself")
+	}
+	if e := el.Value.(*lruEntry); !e.expires.Equal(time.Unix(exp, 0)) {
+		t.Errorf("entry expires at %s, want the token expiry %s", e.expires, time.Unix(exp, 0))
+	}
+
+	for i := 0; i < 3; i++ {
+		token := signToken(t, jwt.SigningMethodHS256, []byte(testSharedSecret), "", map[string]interface{}{"jti": i})
+		if _, err := v.verify(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v.cache.len() != 2 {
+		t.Errorf("%d tokens cached, want the cache size 2", v.cache.len())
+	}
+
+	v, err = newTokenVerifier(testSharedSecret, nil, nil, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.verify(token); err != nil || v.cache != nil {
+		t.Errorf("verify without a cache: %v, cache %v", err, v.cache)
+	}
+}
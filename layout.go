@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"os"
+)
+
+// convertBatchSize is the number of records read at once when
+// converting to the tree layout.
+const convertBatchSize = 500
+
+// convertLayout copies the records stored in the layout other than
+// to into the to layout and removes them from the former. It returns
+// the number of records converted. The service must be stopped while
+// converting and restarted with the to layout.
+func (s *server) convertLayout(ctx context.Context, to string) (int, error) {
+	switch to {
+	case layoutTree:
+		return s.convertToTree(ctx)
+	case layoutPath:
+		return s.convertToPath(ctx)
+	}
+	return 0, fmt.Errorf("unknown layout %q, expected %s or %s", to, layoutPath, layoutTree)
+}
+
+// convertToTree moves the records to the nodes table. Records are
+// read by path, so the nodes of the ancestors are created first.
+func (s *server) convertToTree(ctx context.Context) (int, error) {
+
+	var n int
+	err := s.db.DB().QueryRowContext(ctx, "SELECT COUNT(*) FROM nodes").Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		return 0, fmt.Errorf("%d nodes are already stored in the tree layout", n)
+	}
+
+	converted := 0
+	last := ""
+	for {
+		recs, err := queryRecords(ctx, s.db.DB(), "path > ? ORDER BY path LIMIT ?", last, convertBatchSize)
+		if err != nil {
+			return converted, err
+		}
+		if len(recs) == 0 {
+			break
+		}
+		for _, r := range recs {
+			if r.Path == "/" {
+				log.Warnf("the record of / is not converted, the root has no node in the tree layout")
+				continue
+			}
+			if err := s.treePut(ctx, r.ID, r.Path, r.Checksum, r.ETag, r.MTime); err != nil {
+				return converted, err
+			}
+			converted++
+		}
+		last = recs[len(recs)-1].Path
+	}
+
+	// the names were keyed for the current case sensitivity
+	_, err = s.db.DB().ExecContext(ctx, "UPDATE tree_generation SET case_insensitive=? WHERE id=1", s.paths.caseInsensitive)
+	if err != nil {
+		return converted, err
+	}
+	_, err = s.db.DB().ExecContext(ctx, "DELETE FROM records")
+	return converted, err
+}
+
+// convertToPath moves the nodes to the records table, but the
+// placeholders, which are not records.
+func (s *server) convertToPath(ctx context.Context) (int, error) {
+
+	var n int
+	err := s.db.DB().QueryRowContext(ctx, "SELECT COUNT(*) FROM records").Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		return 0, fmt.Errorf("%d records are already stored in the path layout", n)
+	}
+
+	converted := 0
+	err = s.treeVisit(ctx, nil, func(nd *node, p string) error {
+		if nd.placeholder {
+			return nil
+		}
+		if err := s.insert(ctx, nd.id, p, s.paths.fold(p), nd.checksum, nd.etag, nd.mtime); err != nil {
+			return err
+		}
+		converted++
+		return nil
+	})
+	if err != nil {
+		return converted, err
+	}
+
+	tx, err := s.db.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return converted, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM nodes"); err != nil {
+		return converted, err
+	}
+	if err := bumpTreeGeneration(ctx, tx); err != nil {
+		return converted, err
+	}
+	return converted, tx.Commit()
+}
+
+func convertLayoutCommand(args []string) error {
+	fs, cf := newCommandFlags("convert-layout", "-to path|tree")
+	to := fs.String("to", "", "layout to convert the records to")
+	fs.Parse(args)
+
+	s, err := newCommandServer(cf)
+	if err != nil {
+		return err
+	}
+
+	n, err := s.convertLayout(context.Background(), *to)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d records converted to the %s layout, set layout: %s before starting the service\n", n, *to, *to)
+	return nil
+}
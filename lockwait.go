@@ -0,0 +1,106 @@
+package main
+
+import (
+	stdcontext "context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"strconv"
+	"sync/atomic"
+)
+
+// lockWaitConnector opens the connections of the primary database
+// with an innodb_lock_wait_timeout in seconds, which bounds the writes
+// waiting for row locks. The timeouts can be reloaded, so connections
+// taken from the pool set it again on their session when it changed
+// since they last did.
+type lockWaitConnector struct {
+	dsn string
+
+	// timeout is accessed atomically
+	timeout int64
+}
+
+// newLockWaitDB opens the database of dsn, prepared by mysqlDSN, with
+// connections waiting timeout seconds at most for row locks.
+func newLockWaitDB(dsn string, timeout int) (*gorm.DB, *lockWaitConnector, error) {
+	c := &lockWaitConnector{dsn: dsn, timeout: int64(timeout)}
+	db, err := gorm.Open("mysql", sql.OpenDB(c))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &db, c, nil
+}
+
+// setTimeout changes the timeout of the connections taken from the
+// pool from now on.
+func (c *lockWaitConnector) setTimeout(timeout int) {
+	atomic.StoreInt64(&c.timeout, int64(timeout))
+}
+
+func (c *lockWaitConnector) Connect(ctx stdcontext.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	lc := &lockWaitConn{Conn: conn, connector: c}
+	if err := lc.setTimeout(atomic.LoadInt64(&c.timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return lc, nil
+}
+
+func (c *lockWaitConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
+
+// lockWaitConn is a connection of a lockWaitConnector.
+type lockWaitConn struct {
+	driver.Conn
+	connector *lockWaitConnector
+
+	// timeout is the one set on the session
+	timeout int64
+}
+
+func (lc *lockWaitConn) setTimeout(timeout int64) error {
+	_, err := lc.Exec("SET SESSION innodb_lock_wait_timeout="+strconv.FormatInt(timeout, 10), nil)
+	if err != nil {
+		return err
+	}
+	lc.timeout = timeout
+	return nil
+}
+
+// ResetSession is called by database/sql before a connection is
+// reused.
+func (lc *lockWaitConn) ResetSession(ctx stdcontext.Context) error {
+	timeout := atomic.LoadInt64(&lc.connector.timeout)
+	if timeout == lc.timeout {
+		return nil
+	}
+	if err := lc.setTimeout(timeout); err != nil {
+		// the connection is discarded and another one taken
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+// Exec and Query let the driver run statements without preparing them
+// as it would without the wrapper.
+
+func (lc *lockWaitConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	if e, ok := lc.Conn.(driver.Execer); ok {
+		return e.Exec(query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (lc *lockWaitConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	if q, ok := lc.Conn.(driver.Queryer); ok {
+		return q.Query(query, args)
+	}
+	return nil, driver.ErrSkip
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	c := newLRU(2)
+	c.add("a", 1, time.Time{})
+	c.add("b", 2, time.Time{})
+	// a becomes the most recently used
+	if v, ok := c.get("a"); !ok || v.(int) != 1 {
+		t.Fatalf("get(a) = %v, %t", v, ok)
+	}
+	c.add("c", 3, time.Time{})
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used entry not evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("recently used entry evicted")
+	}
+
+	c.add("a", 4, time.Time{})
+	if v, _ := c.get("a"); v.(int) != 4 || c.len() != 2 {
+		t.Errorf("replaced entry is %v with %d entries, want 4 with 2", v, c.len())
+	}
+
+	c.add("d", 5, time.Now().Add(-time.Second))
+	if _, ok := c.get("d"); ok {
+		t.Error("expired entry returned")
+	}
+	if c.len() != 1 {
+		t.Errorf("%d entries after an expired get, want 1", c.len())
+	}
+
+	c.remove("a")
+	if _, ok := c.get("a"); ok {
+		t.Error("removed entry returned")
+	}
+	c.add("e", 6, time.Now().Add(time.Hour))
+	c.purge()
+	if c.len() != 0 {
+		t.Errorf("%d entries after purge", c.len())
+	}
+}
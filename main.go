@@ -1,14 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"fmt"
 	pb "github.com/clawio/service-localfs-prop/proto/propagator"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
-	"strconv"
+	"time"
 )
 
 const (
@@ -18,89 +22,176 @@ const (
 	logLevelEnvar          = serviceID + "_LOGLEVEL"
 	maxSqlIdleEnvar        = serviceID + "_MAXSQLIDLE"
 	maxSqlConcurrencyEnvar = serviceID + "_MAXSQLCONCURRENCY"
+	debugPortEnvar         = serviceID + "_DEBUGPORT"
+	httpPortEnvar          = serviceID + "_HTTPPORT"
+	davPrefixEnvar         = serviceID + "_DAVPREFIX"
+	normalizationEnvar     = serviceID + "_NORMALIZATION"
+	caseInsensitiveEnvar   = serviceID + "_CASEINSENSITIVE"
+	homeDepthEnvar         = serviceID + "_HOMEDEPTH"
+	layoutEnvar            = serviceID + "_LAYOUT"
+	recordCacheSizeEnvar   = serviceID + "_RECORDCACHESIZE"
+	recordCacheTTLEnvar    = serviceID + "_RECORDCACHETTL"
+	replicaDSNsEnvar       = serviceID + "_REPLICADSNS"
+	readYourWritesEnvar    = serviceID + "_READYOURWRITESWINDOW"
+	tlsCertEnvar           = serviceID + "_TLSCERT"
+	tlsKeyEnvar            = serviceID + "_TLSKEY"
+	tlsClientCAEnvar       = serviceID + "_TLSCLIENTCA"
+	jwtAlgorithmsEnvar     = serviceID + "_JWTALGORITHMS"
+	jwtPublicKeysEnvar     = serviceID + "_JWTPUBLICKEYS"
+	jwksEnvar              = serviceID + "_JWKS"
+	tokenCacheSizeEnvar    = serviceID + "_TOKENCACHESIZE"
+	adminUsersEnvar        = serviceID + "_ADMINUSERS"
+	rateLimitsEnvar        = serviceID + "_RATELIMITS"
+	timeoutsEnvar          = serviceID + "_TIMEOUTS"
 	sharedSecretEnvar      = "CLAWIO_SHAREDSECRET"
 )
 
-type environ struct {
-	dsn               string
-	port              int
-	logLevel          string
-	maxSqlIdle        int
-	maxSqlConcurrency int
-	sharedSecret      string
-}
+// defaultTokenCacheSize is the number of verified tokens kept in memory.
+const defaultTokenCacheSize = 1024
 
-func getEnviron() (*environ, error) {
-	e := &environ{}
-	e.dsn = os.Getenv(dsnEnvar)
-	port, err := strconv.Atoi(os.Getenv(portEnvar))
-	if err != nil {
-		return nil, err
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
 	}
-	e.port = port
 
-	maxSqlIdle, err := strconv.Atoi(os.Getenv(maxSqlIdleEnvar))
+	cf := newConfigFlags(flag.CommandLine)
+	flag.Parse()
+
+	c, err := cf.load()
 	if err != nil {
-		return nil, err
+		// the report spans several lines, keep it readable
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	e.maxSqlIdle = maxSqlIdle
 
-	maxSqlConcurrency, err := strconv.Atoi(os.Getenv(maxSqlConcurrencyEnvar))
-	if err != nil {
-		return nil, err
+	if *cf.printConfig {
+		out, err := c.redactedYAML()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(out)
+		return
 	}
-	e.maxSqlConcurrency = maxSqlConcurrency
-	e.logLevel = os.Getenv(logLevelEnvar)
 
-	e.sharedSecret = os.Getenv(sharedSecretEnvar)
-	return e, nil
-}
-func printEnviron(e *environ) {
-	log.Infof("%s=%s", dsnEnvar, e.dsn)
-	log.Infof("%s=%d", portEnvar, e.port)
-	log.Infof("%s=%d", maxSqlIdleEnvar, e.maxSqlIdle)
-	log.Infof("%s=%d", maxSqlConcurrencyEnvar, e.maxSqlConcurrency)
-	log.Infof("%s=%d", portEnvar, e.port)
-	log.Infof("%s=%s", sharedSecretEnvar, "******")
-}
+	setLogLevel(c)
 
-func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
+	log.Infof("Service %s started", serviceID)
+	printConfig(c)
 
-	env, err := getEnviron()
+	srv, err := newServer(newServerParamsFromConfig(c))
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
 
-	l, err := log.ParseLevel(env.logLevel)
+	// SIGHUP reloads the settings that do not need a restart
+	go newReloader(cf, c, srv).watch()
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Port))
 	if err != nil {
-		l = log.ErrorLevel
+		log.Error(err)
+		os.Exit(1)
 	}
-	log.SetLevel(l)
 
-	log.Infof("Service %s started", serviceID)
-	printEnviron(env)
+	// expose expvar counters and grpc traces under /debug,
+	// only to the local host as they are not authenticated
+	if c.DebugPort > 0 {
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf("localhost:%d", c.DebugPort), newDebugHandler())
+			if err != nil {
+				log.Error(err)
+			}
+		}()
+	}
 
-	p := &newServerParams{}
-	p.dsn = env.dsn
-	p.sharedSecret = env.sharedSecret
-	p.maxSqlIdle = env.maxSqlIdle
-	p.maxSqlConcurrency = env.maxSqlConcurrency
+	opts := []grpc.ServerOption{}
+	if c.TLSCert != "" {
+		tlsConfig, err := newTLSConfig(c.TLSCert, c.TLSKey, c.TLSClientCA, []string{"h2"})
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		log.Infof("TLS enabled")
+	}
+
+	handler := newRecoveryServer(srv, srv)
+
+	if c.HTTPPort > 0 {
+		go serveGateway(c, handler)
+	}
 
-	srv, err := newServer(p)
+	grpcServer := grpc.NewServer(opts...)
+	pb.RegisterPropServer(grpcServer, handler)
+	pb.RegisterAdminServer(grpcServer, handler)
+	grpcServer.Serve(lis)
+}
+
+// serveGateway serves the HTTP/JSON gateway, over TLS if the gRPC
+// listener uses it.
+func serveGateway(c *config, handler pb.PropServer) {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", c.HTTPPort))
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
 
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", env.port))
-	if err != nil {
+	if c.TLSCert != "" {
+		tlsConfig, err := newTLSConfig(c.TLSCert, c.TLSKey, c.TLSClientCA, []string{"http/1.1"})
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+
+	s := &http.Server{}
+	s.Handler = newGateway(handler, c.DAVPrefix)
+	s.ReadHeaderTimeout = 10 * time.Second
+	log.Infof("HTTP gateway listening on port %d", c.HTTPPort)
+	if err := s.Serve(lis); err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
+}
 
-	grpcServer := grpc.NewServer()
-	pb.RegisterPropServer(grpcServer, srv)
-	grpcServer.Serve(lis)
+func setLogLevel(c *config) {
+	l, err := log.ParseLevel(c.LogLevel)
+	if err != nil {
+		l = log.ErrorLevel
+	}
+	log.SetLevel(l)
+}
+
+func newServerParamsFromConfig(c *config) *newServerParams {
+	p := &newServerParams{}
+	p.dsn = c.DSN
+	p.sharedSecret = c.SharedSecret
+	p.maxSqlIdle = c.MaxSQLIdle
+	p.maxSqlConcurrency = c.MaxSQLConcurrency
+	p.normalization = c.Normalization
+	p.caseInsensitive = c.CaseInsensitive
+	p.homeDepth = c.HomeDepth
+	p.layout = c.Layout
+	p.recordCacheSize = c.RecordCacheSize
+	p.recordCacheTTL = c.RecordCacheTTL
+	p.replicaDSNs = c.ReplicaDSNs
+	p.readYourWrites = c.ReadYourWritesWindow
+	p.jwtAlgorithms = c.JWTAlgorithms
+	p.jwtPublicKeys = c.JWTPublicKeys
+	p.jwksFile = c.JWKS
+	p.tokenCacheSize = c.TokenCacheSize
+	p.adminUsers = c.AdminUsers
+	p.limits = c.RateLimits
+	p.timeouts = c.Timeouts
+	return p
 }
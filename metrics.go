@@ -0,0 +1,51 @@
+package main
+
+import (
+	"expvar"
+	"golang.org/x/net/trace"
+	"net/http"
+)
+
+// Counters exported through expvar under /debug/vars.
+// They are served by the optional debug listener, see main.go.
+var (
+	panicsCounter = expvar.NewInt("panics")
+
+	tokenCacheHitsCounter   = expvar.NewInt("token_cache_hits")
+	tokenCacheMissesCounter = expvar.NewInt("token_cache_misses")
+
+	recordCacheHitsCounter   = expvar.NewInt("record_cache_hits")
+	recordCacheMissesCounter = expvar.NewInt("record_cache_misses")
+
+	rateLimitedCounter = expvar.NewInt("rate_limited")
+
+	replicaReadsCounter     = expvar.NewInt("replica_reads")
+	replicaFallbacksCounter = expvar.NewInt("replica_fallbacks")
+)
+
+// newDebugHandler serves the expvar counters and the gRPC traces, which
+// include request metadata. It has a mux of its own so that nothing
+// registered on http.DefaultServeMux by an imported package is exposed.
+func newDebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/requests", func(w http.ResponseWriter, r *http.Request) {
+		any, sensitive := trace.AuthRequest(r)
+		if !any {
+			http.Error(w, "not allowed", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		trace.Render(w, r, sensitive)
+	})
+	mux.HandleFunc("/debug/events", func(w http.ResponseWriter, r *http.Request) {
+		any, sensitive := trace.AuthRequest(r)
+		if !any {
+			http.Error(w, "not allowed", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		trace.RenderEvents(w, r, sensitive)
+	})
+	return mux
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	rus "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// migration is a numbered change of the database schema.
+// Migrations are applied in order and recorded in schema_version,
+// and released ones must never change: add a new one instead.
+// MySQL commits DDL statements implicitly, so a migration failing
+// half way is not rolled back and must be safe to run again.
+type migration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, db *sql.DB) error
+	// down reverts up. It is nil if the migration cannot be
+	// reverted without losing data.
+	down func(ctx context.Context, db *sql.DB) error
+}
+
+// migrations are all the migrations known, by version.
+var migrations = []migration{
+	{1, "create records table", migrateBaseline, nil},
+	{2, "add primary key, path hash and parent path", execSQL(
+		// rows without an ID or a path could never be served
+		"DELETE FROM records WHERE path IS NULL",
+		"UPDATE records SET id=UUID() WHERE id IS NULL OR id=''",
+		// as fsck -repair does, the first path keeps a duplicated ID
+		`UPDATE records r JOIN (SELECT id, MIN(path) AS keep FROM records GROUP BY id HAVING COUNT(*) > 1) d
+		ON r.id=d.id AND r.path<>d.keep SET r.id=UUID()`,
+		`ALTER TABLE records
+		MODIFY id VARCHAR(255) NOT NULL,
+		MODIFY path VARCHAR(255) NOT NULL,
+		ADD PRIMARY KEY (id),
+		ADD COLUMN path_hash BINARY(32) AS (UNHEX(SHA2(path, 256))) STORED,
+		ADD COLUMN parent_path VARCHAR(255) AS (`+parentPathExpr+`) STORED,
+		DROP INDEX idx_path,
+		ADD UNIQUE INDEX idx_path_hash (path_hash),
+		ADD INDEX idx_path (path),
+		ADD INDEX idx_parent_path (parent_path)`,
+	), execSQL(
+		`ALTER TABLE records
+		DROP INDEX idx_parent_path,
+		DROP INDEX idx_path,
+		DROP INDEX idx_path_hash,
+		DROP COLUMN parent_path,
+		DROP COLUMN path_hash,
+		DROP PRIMARY KEY,
+		MODIFY id VARCHAR(255) NULL,
+		MODIFY path VARCHAR(255) NULL,
+		ADD UNIQUE INDEX idx_path (path)`,
+	)},
+	{3, "allow paths of up to 4096 bytes", migrateLongPaths, revertLongPaths},
+	{4, "create nodes table for the tree layout", execSQL(
+		// the parent_id of the top level nodes is empty and fold_name
+		// is the name siblings are unique by: folded in a case
+		// insensitive namespace, the name itself otherwise
+		`CREATE TABLE IF NOT EXISTS nodes (
+		id VARCHAR(255) NOT NULL PRIMARY KEY,
+		parent_id VARCHAR(255) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		fold_name VARCHAR(255) NOT NULL,
+		checksum VARCHAR(255) NOT NULL DEFAULT '',
+		e_tag VARCHAR(255) NOT NULL DEFAULT '',
+		m_time INT UNSIGNED NOT NULL DEFAULT 0,
+		placeholder TINYINT(1) NOT NULL DEFAULT 0,
+		UNIQUE INDEX idx_parent_name (parent_id, name),
+		UNIQUE INDEX idx_parent_fold_name (parent_id, fold_name)
+		) DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`,
+		`CREATE TABLE IF NOT EXISTS tree_generation (
+		id INT NOT NULL PRIMARY KEY,
+		generation BIGINT UNSIGNED NOT NULL,
+		case_insensitive TINYINT(1) NOT NULL DEFAULT 0
+		)`,
+		"INSERT IGNORE INTO tree_generation (id, generation, case_insensitive) VALUES (1, 0, 0)",
+	), revertNodes},
+}
+
+// parentPathExpr computes the parent of the path column, / for the
+// top level paths. Generated columns keep it and the path hash right
+// whatever statement changes the path.
+const parentPathExpr = `IF(LOCATE('/', path, 2) = 0, '/',
+	SUBSTRING(path, 1, CHAR_LENGTH(path) - CHAR_LENGTH(SUBSTRING_INDEX(path, '/', -1)) - 1))`
+
+// latestSchemaVersion is the schema version this build understands.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// execSQL returns a migration step running stmts in order.
+func execSQL(stmts ...string) func(ctx context.Context, db *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		for _, stmt := range stmts {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrateBaseline creates the records table as AutoMigrate used to,
+// with a binary utf8mb4 collation, and brings tables created by
+// AutoMigrate to the same schema. Their default collation, usually
+// latin1_swedish_ci, cannot store most paths and compares them
+// ignoring case and accents. Case insensitivity, when wanted, is
+// handled in the path layer instead.
+func migrateBaseline(ctx context.Context, db *sql.DB) error {
+
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS records (
+	id VARCHAR(255),
+	path VARCHAR(255),
+	fold_path VARCHAR(255),
+	checksum VARCHAR(255),
+	e_tag VARCHAR(255),
+	m_time INT UNSIGNED,
+	UNIQUE INDEX idx_path (path),
+	INDEX idx_fold_path (fold_path)
+) DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`)
+	if err != nil {
+		return err
+	}
+
+	ok, err := columnExists(ctx, db, "records", "fold_path")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if _, err := db.ExecContext(ctx, "ALTER TABLE records ADD COLUMN fold_path VARCHAR(255), ADD INDEX idx_fold_path (fold_path)"); err != nil {
+			return err
+		}
+	}
+
+	var collation string
+	err = db.QueryRowContext(ctx, `SELECT table_collation FROM information_schema.tables
+	WHERE table_schema=DATABASE() AND table_name=?`, "records").Scan(&collation)
+	if err != nil {
+		return err
+	}
+	if collation == "utf8mb4_bin" {
+		return nil
+	}
+	_, err = db.ExecContext(ctx, "ALTER TABLE records CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_bin")
+	return err
+}
+
+// migrateLongPaths makes the path columns TEXT. Only a prefix of
+// them can be indexed, which still serves range scans; uniqueness is
+// kept by the path hash. The generated columns are added again as
+// their type depends on the path column.
+func migrateLongPaths(ctx context.Context, db *sql.DB) error {
+
+	// a previous attempt may have failed after the first step
+	ok, err := columnExists(ctx, db, "records", "path_hash")
+	if err != nil {
+		return err
+	}
+	if ok {
+		_, err := db.ExecContext(ctx, `ALTER TABLE records
+		DROP INDEX idx_parent_path,
+		DROP INDEX idx_path_hash,
+		DROP COLUMN parent_path,
+		DROP COLUMN path_hash`)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.ExecContext(ctx, `ALTER TABLE records
+	DROP INDEX idx_path,
+	DROP INDEX idx_fold_path,
+	MODIFY path TEXT NOT NULL,
+	MODIFY fold_path TEXT,
+	ADD COLUMN path_hash BINARY(32) AS (UNHEX(SHA2(path, 256))) STORED,
+	ADD COLUMN parent_path TEXT AS (`+parentPathExpr+`) STORED,
+	ADD UNIQUE INDEX idx_path_hash (path_hash),
+	ADD INDEX idx_path (path(`+indexPrefixLength+`)),
+	ADD INDEX idx_fold_path (fold_path(`+indexPrefixLength+`)),
+	ADD INDEX idx_parent_path (parent_path(`+indexPrefixLength+`))`)
+	return err
+}
+
+// indexPrefixLength is the number of characters of the path columns
+// indexed, the most that fits the 3072 bytes of an InnoDB index key.
+const indexPrefixLength = "768"
+
+// revertLongPaths undoes migrateLongPaths if no path is too long
+// for the VARCHAR(255) columns.
+func revertLongPaths(ctx context.Context, db *sql.DB) error {
+
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM records WHERE CHAR_LENGTH(path) > 255").Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%d paths are longer than 255 characters, move or remove them first", n)
+	}
+
+	ok, err := columnExists(ctx, db, "records", "path_hash")
+	if err != nil {
+		return err
+	}
+	if ok {
+		_, err := db.ExecContext(ctx, `ALTER TABLE records
+		DROP INDEX idx_parent_path,
+		DROP INDEX idx_path_hash,
+		DROP COLUMN parent_path,
+		DROP COLUMN path_hash`)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.ExecContext(ctx, `ALTER TABLE records
+	DROP INDEX idx_path,
+	DROP INDEX idx_fold_path,
+	MODIFY path VARCHAR(255) NOT NULL,
+	MODIFY fold_path VARCHAR(255),
+	ADD COLUMN path_hash BINARY(32) AS (UNHEX(SHA2(path, 256))) STORED,
+	ADD COLUMN parent_path VARCHAR(255) AS (`+parentPathExpr+`) STORED,
+	ADD UNIQUE INDEX idx_path_hash (path_hash),
+	ADD INDEX idx_path (path),
+	ADD INDEX idx_fold_path (fold_path),
+	ADD INDEX idx_parent_path (parent_path)`)
+	return err
+}
+
+// revertNodes drops the tables of the tree layout if it holds
+// no nodes, convert-layout moves them back to the records first.
+func revertNodes(ctx context.Context, db *sql.DB) error {
+
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM nodes").Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%d nodes are stored in the tree layout, convert them with convert-layout -to path first", n)
+	}
+	return execSQL("DROP TABLE nodes", "DROP TABLE tree_generation")(ctx, db)
+}
+
+// columnExists tells if table has the column.
+func columnExists(ctx context.Context, db *sql.DB, table, column string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.columns
+	WHERE table_schema=DATABASE() AND table_name=? AND column_name=?`, table, column).Scan(&n)
+	return n > 0, err
+}
+
+// schemaVersion returns the version of the schema of db, 0 if no
+// migration was applied yet.
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (
+	version INT NOT NULL PRIMARY KEY,
+	description VARCHAR(255) NOT NULL,
+	applied_at BIGINT NOT NULL
+)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+const (
+	// migrationLock is the MySQL named lock held while migrating.
+	migrationLock = "localfs_prop_migrate"
+
+	// migrationLockTimeout is how long, in seconds, an instance waits
+	// for another one to finish migrating.
+	migrationLockTimeout = 600
+)
+
+// lockMigrations takes the migration lock, so that instances starting
+// together migrate one after the other, and returns the function
+// releasing it. Named locks belong to a connection, which is kept
+// out of the pool until then.
+func lockMigrations(ctx context.Context, db *sql.DB) (func(), error) {
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", migrationLock, migrationLockTimeout).Scan(&locked)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("timed out after %ds waiting for another instance to migrate", migrationLockTimeout)
+	}
+
+	return func() {
+		var released sql.NullInt64
+		err := conn.QueryRowContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLock).Scan(&released)
+		if err != nil {
+			rus.Error(err)
+		}
+		conn.Close()
+	}, nil
+}
+
+// migrateUp applies the migrations after the current version up to target.
+// It fails if the schema is newer than this build understands.
+func migrateUp(ctx context.Context, db *sql.DB, target int) error {
+
+	unlock, err := lockMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// read holding the lock, another instance may just have migrated
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current > latestSchemaVersion() {
+		return fmt.Errorf("schema version %d is newer than %d, the latest this build understands", current, latestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+
+		rus.Infof("applying migration %d: %s", m.version, m.description)
+		if err := m.up(ctx, db); err != nil {
+			return fmt.Errorf("migration %d failed: %s", m.version, err)
+		}
+		_, err := db.ExecContext(ctx, "INSERT INTO schema_version (version, description, applied_at) VALUES (?,?,?)",
+			m.version, m.description, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDown reverts the migrations after target, newest first.
+func migrateDown(ctx context.Context, db *sql.DB, target int) error {
+
+	unlock, err := lockMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current > latestSchemaVersion() {
+		return fmt.Errorf("schema version %d is newer than %d, revert it with a newer build", current, latestSchemaVersion())
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+		if m.down == nil {
+			return fmt.Errorf("migration %d (%s) cannot be reverted", m.version, m.description)
+		}
+
+		rus.Infof("reverting migration %d: %s", m.version, m.description)
+		if err := m.down(ctx, db); err != nil {
+			return fmt.Errorf("reverting migration %d failed: %s", m.version, err)
+		}
+		if _, err := db.ExecContext(ctx, "DELETE FROM schema_version WHERE version=?", m.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printMigrations prints every migration and when it was applied.
+func printMigrations(ctx context.Context, db *sql.DB, w io.Writer) error {
+
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	applied := map[int]int64{}
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); err != nil {
+			return err
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tAPPLIED\tDESCRIPTION")
+	for _, m := range migrations {
+		at := "pending"
+		if t, ok := applied[m.version]; ok {
+			at = time.Unix(t, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", m.version, at, m.description)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "schema version %d, latest %d\n", current, latestSchemaVersion())
+	if current > latestSchemaVersion() {
+		fmt.Fprintln(w, "the schema is newer than this build understands")
+	}
+	return nil
+}
+
+func migrateCommand(args []string) error {
+	fs, cf := newCommandFlags("migrate", "status|up|down [-to <version>]")
+	to := fs.Int("to", -1, "version to migrate to, the latest one for up and the previous one for down")
+
+	if len(args) < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+
+	c, err := cf.load()
+	if err != nil {
+		return err
+	}
+	setLogLevel(c)
+
+	db, err := newDB("mysql", c.DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	switch action {
+	case "status":
+		return printMigrations(ctx, db.DB(), os.Stdout)
+
+	case "up":
+		target := *to
+		if target < 0 {
+			target = latestSchemaVersion()
+		}
+		if err := migrateUp(ctx, db.DB(), target); err != nil {
+			return err
+		}
+
+	case "down":
+		target := *to
+		if target < 0 {
+			current, err := schemaVersion(ctx, db.DB())
+			if err != nil {
+				return err
+			}
+			target = current - 1
+		}
+		if err := migrateDown(ctx, db.DB(), target); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown migrate action %q, expected status, up or down", action)
+	}
+
+	version, err := schemaVersion(ctx, db.DB())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version %d\n", version)
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The benchmarks run against benchDirs*benchDirs*benchDirs records
+// laid out as /bench/uNNN/dNNN/fNNN and check first that the queries
+// they time use the indexes instead of scanning the table.
+const benchDirs = 100
+
+var (
+	benchOnce   sync.Once
+	benchServer *server
+	benchErr    error
+)
+
+// seededServer returns a server with the path layout on the test
+// database seeded with the benchmark records, once per run.
+func seededServer(b *testing.B) *server {
+	b.Helper()
+	testDSN(b)
+	benchOnce.Do(func() {
+		s := newTestServer(b, layoutPath)
+
+		values := []interface{}{}
+		flush := func() error {
+			if len(values) == 0 {
+				return nil
+			}
+			rows := strings.TrimSuffix(strings.Repeat("(?,?,?,'','bench',0),", len(values)/3), ",")
+			_, err := s.db.DB().Exec("INSERT INTO records (id,path,fold_path,checksum,e_tag,m_time) VALUES "+rows, values...)
+			values = values[:0]
+			return err
+		}
+
+		n := 0
+		for u := 0; u < benchDirs && benchErr == nil; u++ {
+			for d := 0; d < benchDirs && benchErr == nil; d++ {
+				for f := 0; f < benchDirs; f++ {
+					p := fmt.Sprintf("/bench/u%03d/d%03d/f%03d", u, d, f)
+					values = append(values, fmt.Sprintf("bench-%d", n), p, s.paths.fold(p))
+					n++
+				}
+				benchErr = flush()
+			}
+		}
+		benchServer = s
+	})
+	if benchErr != nil {
+		b.Fatal(benchErr)
+	}
+	if benchServer == nil {
+		b.Fatal("the benchmark records could not be seeded")
+	}
+	return benchServer
+}
+
+// assertIndexed fails b unless MySQL plans to read the records
+// matching where through index.
+func assertIndexed(b *testing.B, s *server, index, where string, args ...interface{}) {
+	b.Helper()
+
+	rows, err := s.db.DB().Query("EXPLAIN SELECT "+recordColumns+" FROM records WHERE "+where, args...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		dest := make([]interface{}, len(cols))
+		for i := range vals {
+			dest[i] = &vals[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			b.Fatal(err)
+		}
+		plan := map[string]string{}
+		for i, col := range cols {
+			plan[col] = vals[i].String
+		}
+		if plan["key"] != index || (plan["type"] != "ref" && plan["type"] != "range") {
+			b.Fatalf("%s: plan uses key %q with access type %q, want %s", where, plan["key"], plan["type"], index)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkListChildren(b *testing.B) {
+	s := seededServer(b)
+	p := "/bench/u042/d017"
+	assertIndexed(b, s, "idx_parent_path", "parent_path=? ORDER BY path", p)
+
+	token := testToken(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := s.List(context.Background(), &pb.ListReq{AccessToken: token, Path: p})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(res.Records) != benchDirs {
+			b.Fatalf("listed %d records, want %d", len(res.Records), benchDirs)
+		}
+	}
+}
+
+func BenchmarkListRecursive(b *testing.B) {
+	s := seededServer(b)
+	p := "/bench/u042"
+	assertIndexed(b, s, "idx_path", "path LIKE ? ESCAPE '"+likeEscape+"' ORDER BY path", likePrefix(p+"/"))
+
+	token := testToken(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := s.List(context.Background(), &pb.ListReq{AccessToken: token, Path: p, Recursive: true})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(res.Records) != benchDirs*benchDirs {
+			b.Fatalf("listed %d records, want %d", len(res.Records), benchDirs*benchDirs)
+		}
+	}
+}
+
+// BenchmarkMvPrefix renames a directory of benchDirs records
+// back and forth.
+func BenchmarkMvPrefix(b *testing.B) {
+	s := seededServer(b)
+	src, dst := "/bench/u007/d003", "/bench/u007/moved"
+	assertIndexed(b, s, "idx_path", "path LIKE ? ESCAPE '"+likeEscape+"' OR path=?", likePrefix(src+"/"), src)
+
+	token := testToken(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &pb.MvReq{AccessToken: token, Src: src, Dst: dst}
+		if i%2 == 1 {
+			req.Src, req.Dst = dst, src
+		}
+		if _, err := s.Mv(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	if b.N%2 == 1 {
+		if _, err := s.Mv(context.Background(), &pb.MvReq{AccessToken: token, Src: dst, Dst: src}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"io"
+	"os"
+	"path"
+)
+
+// normalizeBatchSize is the number of records read at once.
+const normalizeBatchSize = 1000
+
+// normalizeReport lists the paths normalize changed and those it
+// could not change.
+type normalizeReport struct {
+	checked        int
+	normalized     []string
+	collisions     []string
+	invalid        []string
+	caseCollisions []string
+}
+
+func (r *normalizeReport) print(w io.Writer, dryRun bool) {
+	for _, v := range r.normalized {
+		fmt.Fprintf(w, "normalized     %s\n", v)
+	}
+	for _, v := range r.collisions {
+		fmt.Fprintf(w, "collision      %s\n", v)
+	}
+	for _, v := range r.invalid {
+		fmt.Fprintf(w, "invalid        %s\n", v)
+	}
+	for _, v := range r.caseCollisions {
+		fmt.Fprintf(w, "case-collision %s\n", v)
+	}
+
+	verb := "normalized"
+	if dryRun {
+		verb = "to normalize"
+	}
+	fmt.Fprintf(w, "%d paths checked: %d %s, %d collisions, %d invalid, %d case collisions\n",
+		r.checked, len(r.normalized), verb, len(r.collisions), len(r.invalid), len(r.caseCollisions))
+	if !r.clean() {
+		fmt.Fprintln(w, "rename or remove one path of each collision and the invalid paths, then run normalize again")
+	}
+}
+
+func (r *normalizeReport) clean() bool {
+	return len(r.collisions)+len(r.invalid)+len(r.caseCollisions) == 0
+}
+
+func normalizeCommand(args []string) error {
+	fs, cf := newCommandFlags("normalize", "[-dry-run]")
+	dryRun := fs.Bool("dry-run", false, "only report the paths to normalize")
+	fs.Parse(args)
+
+	s, err := newCommandServer(cf)
+	if err != nil {
+		return err
+	}
+
+	report, err := s.normalize(context.Background(), *dryRun)
+	if err != nil {
+		return err
+	}
+	report.print(os.Stdout, *dryRun)
+	if !report.clean() {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// normalize rewrites the stored paths, or the node names in the tree
+// layout, in the configured normalization form and recomputes their
+// folded keys. It must be run after changing the normalization or
+// upgrading from a version storing paths as sent by clients, as the
+// paths in another form can no longer be reached.
+//
+// A path whose normalized form is already stored, or only differs in
+// case from a stored one in a case insensitive namespace, is left as
+// it is and reported as a collision: which of both records to keep
+// is for an administrator to decide.
+func (s *server) normalize(ctx context.Context, dryRun bool) (*normalizeReport, error) {
+
+	report := &normalizeReport{}
+	if s.tree {
+		return report, s.normalizeNodes(ctx, dryRun, report)
+	}
+	if err := s.normalizeRecords(ctx, dryRun, report); err != nil {
+		return nil, err
+	}
+	if !s.paths.caseInsensitive {
+		return report, nil
+	}
+	return report, s.normalizeCaseCollisions(ctx, report)
+}
+
+func (s *server) normalizeRecords(ctx context.Context, dryRun bool, report *normalizeReport) error {
+
+	// records are read in path_hash order, which is unique; a record
+	// whose path changes may be read again and is then left as it is
+	last := []byte{}
+	for {
+		rows, err := s.db.DB().QueryContext(ctx,
+			"SELECT path_hash, path, fold_path FROM records WHERE path_hash > ? ORDER BY path_hash LIMIT ?",
+			last, normalizeBatchSize)
+		if err != nil {
+			return err
+		}
+		type stored struct{ path, foldPath string }
+		recs := []stored{}
+		for rows.Next() {
+			var r stored
+			var foldPath sql.NullString
+			if err := rows.Scan(&last, &r.path, &foldPath); err != nil {
+				rows.Close()
+				return err
+			}
+			r.foldPath = foldPath.String
+			recs = append(recs, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			return nil
+		}
+
+		for _, r := range recs {
+			report.checked++
+			p, err := s.paths.canonical(r.path)
+			if err != nil {
+				report.invalid = append(report.invalid, fmt.Sprintf("%s: %s", r.path, err))
+				continue
+			}
+			foldPath := s.paths.fold(p)
+			if p == r.path && foldPath == r.foldPath {
+				continue
+			}
+
+			if p != r.path {
+				exists, err := s.normalizeTargetExists(ctx, "records", "path=?", p)
+				if err != nil {
+					return err
+				}
+				if exists {
+					report.collisions = append(report.collisions, fmt.Sprintf("%s: normalizes to %s, which is stored", r.path, p))
+					continue
+				}
+				report.normalized = append(report.normalized, fmt.Sprintf("%s -> %s", r.path, p))
+			}
+			if dryRun {
+				continue
+			}
+
+			_, err = s.db.DB().ExecContext(ctx, "UPDATE records SET path=?, fold_path=? WHERE path=?", p, foldPath, r.path)
+			if e, ok := err.(*mysql.MySQLError); ok && e.Number == mysqlErrDupEntry {
+				// stored since it was checked
+				report.normalized = report.normalized[:len(report.normalized)-1]
+				report.collisions = append(report.collisions, fmt.Sprintf("%s: normalizes to %s, which is stored", r.path, p))
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		rus.Infof("checked the paths of %d records", report.checked)
+	}
+}
+
+// normalizeCaseCollisions reports the records whose paths only differ
+// in case, which a case insensitive namespace cannot tell apart.
+func (s *server) normalizeCaseCollisions(ctx context.Context, report *normalizeReport) error {
+
+	rows, err := s.db.DB().QueryContext(ctx,
+		"SELECT GROUP_CONCAT(path ORDER BY path SEPARATOR ', ') FROM records GROUP BY fold_path HAVING COUNT(*) > 1")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var paths string
+		if err := rows.Scan(&paths); err != nil {
+			return err
+		}
+		report.caseCollisions = append(report.caseCollisions, paths)
+	}
+	return rows.Err()
+}
+
+func (s *server) normalizeNodes(ctx context.Context, dryRun bool, report *normalizeReport) error {
+
+	type rename struct {
+		n       node
+		p       string
+		name    string
+		foldKey string
+	}
+	renames := []rename{}
+	err := s.treeVisit(ctx, nil, func(n *node, p string) error {
+		report.checked++
+		name := s.paths.normalized(n.name)
+		if name == n.name {
+			return nil
+		}
+		if len(name) > maxNameLength {
+			report.invalid = append(report.invalid, fmt.Sprintf("%s: name of %d bytes once normalized exceeds %d", p, len(name), maxNameLength))
+			return nil
+		}
+		renames = append(renames, rename{*n, p, name, s.pathKey(name)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	changed := 0
+	for _, r := range renames {
+		p := path.Join(path.Dir(r.p), r.name)
+		exists, err := s.normalizeTargetExists(ctx, "nodes", "parent_id=? AND id<>? AND (name=? OR fold_name=?)",
+			r.n.parentID, r.n.id, r.name, r.foldKey)
+		if err != nil {
+			return err
+		}
+		if exists {
+			report.collisions = append(report.collisions, fmt.Sprintf("%s: normalizes to %s, which is stored", r.p, p))
+			continue
+		}
+		if !dryRun {
+			res, err := s.db.DB().ExecContext(ctx, "UPDATE nodes SET name=?, fold_name=? WHERE id=? AND name=?",
+				r.name, r.foldKey, r.n.id, r.n.name)
+			if e, ok := err.(*mysql.MySQLError); ok && e.Number == mysqlErrDupEntry {
+				report.collisions = append(report.collisions, fmt.Sprintf("%s: normalizes to %s, which is stored", r.p, p))
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			// renamed or removed since it was read
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				continue
+			}
+			changed++
+		}
+		report.normalized = append(report.normalized, fmt.Sprintf("%s -> %s", r.p, p))
+	}
+	rekeyed, err := s.normalizeNodeKeys(ctx, dryRun, report)
+	if err != nil {
+		return err
+	}
+	if changed+rekeyed == 0 {
+		return nil
+	}
+
+	// drop the paths resolved under the previous names
+	tx, err := s.db.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := bumpTreeGeneration(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// normalizeNodeKeys recomputes the folded names that are not the key
+// of their name, as happens when the folding changes, and returns the
+// number of nodes rekeyed. Siblings getting the same key are reported
+// as case collisions.
+func (s *server) normalizeNodeKeys(ctx context.Context, dryRun bool, report *normalizeReport) (int, error) {
+
+	n := 0
+	last := ""
+	for {
+		rows, err := s.db.DB().QueryContext(ctx, "SELECT id, parent_id, name, fold_name FROM nodes WHERE id > ? ORDER BY id LIMIT ?", last, normalizeBatchSize)
+		if err != nil {
+			return n, err
+		}
+		type keyed struct{ id, parentID, name, foldKey string }
+		nodes := []keyed{}
+		for rows.Next() {
+			var k keyed
+			if err := rows.Scan(&k.id, &k.parentID, &k.name, &k.foldKey); err != nil {
+				rows.Close()
+				return n, err
+			}
+			nodes = append(nodes, k)
+			last = k.id
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return n, err
+		}
+		if len(nodes) == 0 {
+			return n, nil
+		}
+
+		for _, k := range nodes {
+			key := s.pathKey(k.name)
+			if key == k.foldKey {
+				continue
+			}
+			collision := fmt.Sprintf("node %s named %q has a sibling with the same key %q", k.id, k.name, key)
+			if dryRun {
+				exists, err := s.normalizeTargetExists(ctx, "nodes", "parent_id=? AND id<>? AND fold_name=?", k.parentID, k.id, key)
+				if err != nil {
+					return n, err
+				}
+				if exists {
+					report.caseCollisions = append(report.caseCollisions, collision)
+				}
+				continue
+			}
+			_, err := s.db.DB().ExecContext(ctx, "UPDATE nodes SET fold_name=? WHERE id=? AND name=?", key, k.id, k.name)
+			if e, ok := err.(*mysql.MySQLError); ok && e.Number == mysqlErrDupEntry {
+				report.caseCollisions = append(report.caseCollisions, collision)
+				continue
+			}
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
+
+// normalizeTargetExists tells whether a row of table matches where,
+// which is the normalized form of another.
+func (s *server) normalizeTargetExists(ctx context.Context, table, where string, args ...interface{}) (bool, error) {
+	var n int
+	err := s.db.DB().QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE "+where, args...).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxPathLength is the maximum size in bytes of a path, PATH_MAX
+	// on Linux. The path columns are TEXT and only a prefix of them is
+	// indexed, so it is not bound by the index key size.
+	maxPathLength = 4096
+
+	// maxNameLength is the maximum size in bytes of a path element,
+	// NAME_MAX on most file systems.
+	maxNameLength = 255
+
+	// maxPathDepth is the maximum number of elements of a path.
+	maxPathDepth = 64
+
+	// defaultHomeDepth is the number of elements of a home
+	// directory, e.g. /local/users/d/demo. Changes are only
+	// propagated up to the home directory.
+	defaultHomeDepth = 4
+)
+
+// pathError is returned when a path sent by a client is not acceptable.
+type pathError struct {
+	path   string
+	reason string
+}
+
+func (e *pathError) Error() string {
+	return fmt.Sprintf("invalid path %q: %s", e.path, e.reason)
+}
+
+// canonicalPath validates p and returns its canonical form.
+// All the paths coming from clients must pass through it before
+// being used against the database.
+func canonicalPath(p string) (string, error) {
+
+	if p == "" {
+		return "", &pathError{p, "path is empty"}
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		return "", &pathError{p, "path is not absolute"}
+	}
+
+	if !utf8.ValidString(p) {
+		return "", &pathError{p, "path is not valid UTF-8"}
+	}
+
+	for _, r := range p {
+		if r < 0x20 || r == 0x7f {
+			return "", &pathError{p, "path contains control characters"}
+		}
+	}
+
+	// path.Clean silently resolves ".." so /a/../../b would become /b.
+	// We reject them instead of guessing what the client meant.
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return "", &pathError{p, "path contains .. elements"}
+		}
+		if len(elem) > maxNameLength {
+			return "", &pathError{p, fmt.Sprintf("path has an element longer than %d bytes", maxNameLength)}
+		}
+	}
+
+	p = path.Clean(p)
+
+	if len(p) > maxPathLength {
+		return "", &pathError{p, fmt.Sprintf("path is longer than %d bytes", maxPathLength)}
+	}
+
+	if depth := strings.Count(p, "/"); depth > maxPathDepth {
+		return "", &pathError{p, fmt.Sprintf("path is deeper than %d elements", maxPathDepth)}
+	}
+
+	return p, nil
+}
+
+// pathPolicy holds the namespace rules applied to client paths
+// on top of the structural checks done by canonicalPath.
+type pathPolicy struct {
+	// normalize is false when paths are stored as sent by clients.
+	normalize bool
+	form      norm.Form
+
+	// caseInsensitive makes paths that only differ in case
+	// refer to the same record. Paths keep the case they were
+	// created with and lookups go through their folded form.
+	caseInsensitive bool
+}
+
+func newPathPolicy(normalization string, caseInsensitive bool) (*pathPolicy, error) {
+	pp := &pathPolicy{caseInsensitive: caseInsensitive}
+
+	switch strings.ToLower(normalization) {
+	case "", "nfc":
+		pp.normalize, pp.form = true, norm.NFC
+	case "nfd":
+		pp.normalize, pp.form = true, norm.NFD
+	case "nfkc":
+		pp.normalize, pp.form = true, norm.NFKC
+	case "nfkd":
+		pp.normalize, pp.form = true, norm.NFKD
+	case "none":
+		pp.normalize = false
+	default:
+		return nil, fmt.Errorf("unknown normalization form %q", normalization)
+	}
+
+	return pp, nil
+}
+
+// canonical normalizes p with the configured form and validates it.
+// Normalization happens before validation because it can change
+// the length of the path.
+func (pp *pathPolicy) canonical(p string) (string, error) {
+	if !utf8.ValidString(p) {
+		return "", &pathError{p, "path is not valid UTF-8"}
+	}
+
+	return canonicalPath(pp.normalized(p))
+}
+
+// normalized returns s, a path or a name, in the configured form.
+func (pp *pathPolicy) normalized(s string) string {
+	if pp.normalize {
+		return pp.form.String(s)
+	}
+	return s
+}
+
+// fold returns the key used to compare paths when the namespace is
+// case insensitive. It must only be called on canonical paths.
+//
+// Every rune is mapped to the lower case of its upper case, so runes
+// with several lower case forms, like the final sigma, share a key.
+// Folds to several runes, like ß to ss, are not applied: "straße" and
+// "STRASSE" are different paths.
+func (pp *pathPolicy) fold(p string) string {
+	return strings.Map(foldRune, p)
+}
+
+func foldRune(r rune) rune {
+	return unicode.ToLower(unicode.ToUpper(r))
+}
+
+// isAncestor reports whether a is a strict ancestor of p.
+// Both paths must be canonical.
+func isAncestor(a, p string) bool {
+	if a == "/" {
+		return p != "/"
+	}
+	return strings.HasPrefix(p, a+"/")
+}
+
+// pathAndAncestors returns p and all its ancestors but the root,
+// from the shallowest to p. p must be canonical.
+func pathAndAncestors(p string) []string {
+	paths := []string{}
+	for i := 1; i < len(p); i++ {
+		if p[i] == '/' {
+			paths = append(paths, p[:i])
+		}
+	}
+	if p != "/" {
+		paths = append(paths, p)
+	}
+	return paths
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// longPath returns an absolute path with an element
+// of each of sizes bytes.
+func longPath(sizes ...int) string {
+	p := ""
+	for i, size := range sizes {
+		p += "/" + strings.Repeat(string('a'+byte(i%26)), size)
+	}
+	return p
+}
+
+// repeatSize returns n times size.
+func repeatSize(n, size int) []int {
+	sizes := []int{}
+	for i := 0; i < n; i++ {
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+func TestCanonicalPathLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{"4096 bytes", longPath(repeatSize(16, 255)...), true},
+		{"4096 bytes with a trailing slash", longPath(repeatSize(16, 255)...) + "/", true},
+		{"4097 bytes", longPath(append(repeatSize(15, 255), 254, 1)...), false},
+		{"255 byte name", longPath(255), true},
+		{"256 byte name", longPath(256), false},
+		{"depth 64", longPath(repeatSize(64, 1)...), true},
+		{"depth 65", longPath(repeatSize(65, 1)...), false},
+		{"depth 64 with empty elements", longPath(repeatSize(64, 1)...) + "//", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := canonicalPath(tt.path)
+			if !tt.ok {
+				if _, ok := err.(*pathError); !ok {
+					t.Fatalf("error = %v, want a *pathError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != strings.TrimRight(tt.path, "/") {
+				t.Errorf("path = %q, want %q", p, strings.TrimRight(tt.path, "/"))
+			}
+		})
+	}
+}
+
+func TestFold(t *testing.T) {
+	pp, err := newPathPolicy("nfc", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"/Photos/Café", "/photos/CAFÉ", true},
+		{"/ΣΟΦΟΣ", "/σοφος", true},
+		{"/σοφος", "/σοφοσ", true},
+		{"/ſ", "/S", true},
+		{"/\u212a", "/k", true},
+		{"/a", "/b", false},
+		// folds to several runes are not applied
+		{"/straße", "/STRASSE", false},
+	}
+	for _, tt := range tests {
+		if same := pp.fold(tt.a) == pp.fold(tt.b); same != tt.same {
+			t.Errorf("fold(%q) == fold(%q) is %t, want %t", tt.a, tt.b, same, tt.same)
+		}
+	}
+}
@@ -14,7 +14,13 @@ It has these top-level messages:
 	GetReq
 	RmReq
 	MvReq
+	ListReq
 	Record
+	Records
+	ExportReq
+	Chunk
+	ImportReq
+	ImportRes
 */
 package propagator
 
@@ -40,6 +46,8 @@ func (m *Void) String() string { return proto.CompactTextString(m) }
 func (*Void) ProtoMessage()    {}
 
 type PutReq struct {
+	// Optional. The bearer token in the authorization metadata
+	// takes precedence over this field.
 	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
 	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
 	Checksum    string `protobuf:"bytes,3,opt,name=checksum" json:"checksum,omitempty"`
@@ -50,6 +58,8 @@ func (m *PutReq) String() string { return proto.CompactTextString(m) }
 func (*PutReq) ProtoMessage()    {}
 
 type GetReq struct {
+	// Optional. The bearer token in the authorization metadata
+	// takes precedence over this field.
 	AccessToken   string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
 	Path          string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
 	ForceCreation bool   `protobuf:"varint,3,opt,name=force_creation" json:"force_creation,omitempty"`
@@ -60,6 +70,8 @@ func (m *GetReq) String() string { return proto.CompactTextString(m) }
 func (*GetReq) ProtoMessage()    {}
 
 type RmReq struct {
+	// Optional. The bearer token in the authorization metadata
+	// takes precedence over this field.
 	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
 	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
 }
@@ -69,6 +81,8 @@ func (m *RmReq) String() string { return proto.CompactTextString(m) }
 func (*RmReq) ProtoMessage()    {}
 
 type MvReq struct {
+	// Optional. The bearer token in the authorization metadata
+	// takes precedence over this field.
 	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
 	Src         string `protobuf:"bytes,2,opt,name=src" json:"src,omitempty"`
 	Dst         string `protobuf:"bytes,3,opt,name=dst" json:"dst,omitempty"`
@@ -78,6 +92,19 @@ func (m *MvReq) Reset()         { *m = MvReq{} }
 func (m *MvReq) String() string { return proto.CompactTextString(m) }
 func (*MvReq) ProtoMessage()    {}
 
+type ListReq struct {
+	// Optional. The bearer token in the authorization metadata
+	// takes precedence over this field.
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	// List every descendant instead of the direct children only.
+	Recursive bool `protobuf:"varint,3,opt,name=recursive" json:"recursive,omitempty"`
+}
+
+func (m *ListReq) Reset()         { *m = ListReq{} }
+func (m *ListReq) String() string { return proto.CompactTextString(m) }
+func (*ListReq) ProtoMessage()    {}
+
 type Record struct {
 	Id       string `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
 	Path     string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
@@ -90,6 +117,65 @@ func (m *Record) Reset()         { *m = Record{} }
 func (m *Record) String() string { return proto.CompactTextString(m) }
 func (*Record) ProtoMessage()    {}
 
+type Records struct {
+	Records []*Record `protobuf:"bytes,1,rep,name=records" json:"records,omitempty"`
+}
+
+func (m *Records) Reset()         { *m = Records{} }
+func (m *Records) String() string { return proto.CompactTextString(m) }
+func (*Records) ProtoMessage()    {}
+
+func (m *Records) GetRecords() []*Record {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
+type ExportReq struct {
+	// Optional. The bearer token in the authorization metadata
+	// takes precedence over this field.
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+}
+
+func (m *ExportReq) Reset()         { *m = ExportReq{} }
+func (m *ExportReq) String() string { return proto.CompactTextString(m) }
+func (*ExportReq) ProtoMessage()    {}
+
+type Chunk struct {
+	Data []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (m *Chunk) Reset()         { *m = Chunk{} }
+func (m *Chunk) String() string { return proto.CompactTextString(m) }
+func (*Chunk) ProtoMessage()    {}
+
+type ImportReq struct {
+	// Optional. The bearer token in the authorization metadata
+	// takes precedence over this field.
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	// Path the records are imported under, the exported path by default.
+	Root string `protobuf:"bytes,2,opt,name=root" json:"root,omitempty"`
+	// Keep the exported IDs instead of generating new ones.
+	PreserveIds bool `protobuf:"varint,3,opt,name=preserve_ids" json:"preserve_ids,omitempty"`
+	// Replace the records under root instead of failing if there are any.
+	Replace bool   `protobuf:"varint,4,opt,name=replace" json:"replace,omitempty"`
+	Data    []byte `protobuf:"bytes,5,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (m *ImportReq) Reset()         { *m = ImportReq{} }
+func (m *ImportReq) String() string { return proto.CompactTextString(m) }
+func (*ImportReq) ProtoMessage()    {}
+
+type ImportRes struct {
+	Imported uint64 `protobuf:"varint,1,opt,name=imported" json:"imported,omitempty"`
+}
+
+func (m *ImportRes) Reset()         { *m = ImportRes{} }
+func (m *ImportRes) String() string { return proto.CompactTextString(m) }
+func (*ImportRes) ProtoMessage()    {}
+
 // Reference imports to suppress errors if they are not otherwise used.
 var _ context.Context
 var _ grpc.ClientConn
@@ -102,6 +188,7 @@ type PropClient interface {
 	// rpc Cp(CpReq) returns (Void) {}
 	Mv(ctx context.Context, in *MvReq, opts ...grpc.CallOption) (*Void, error)
 	Rm(ctx context.Context, in *RmReq, opts ...grpc.CallOption) (*Void, error)
+	List(ctx context.Context, in *ListReq, opts ...grpc.CallOption) (*Records, error)
 }
 
 type propClient struct {
@@ -148,6 +235,15 @@ func (c *propClient) Rm(ctx context.Context, in *RmReq, opts ...grpc.CallOption)
 	return out, nil
 }
 
+func (c *propClient) List(ctx context.Context, in *ListReq, opts ...grpc.CallOption) (*Records, error) {
+	out := new(Records)
+	err := grpc.Invoke(ctx, "/propagator.Prop/List", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for Prop service
 
 type PropServer interface {
@@ -156,6 +252,7 @@ type PropServer interface {
 	// rpc Cp(CpReq) returns (Void) {}
 	Mv(context.Context, *MvReq) (*Void, error)
 	Rm(context.Context, *RmReq) (*Void, error)
+	List(context.Context, *ListReq) (*Records, error)
 }
 
 func RegisterPropServer(s *grpc.Server, srv PropServer) {
@@ -210,6 +307,18 @@ func _Prop_Rm_Handler(srv interface{}, ctx context.Context, dec func(interface{}
 	return out, nil
 }
 
+func _Prop_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(ListReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(PropServer).List(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 var _Prop_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "propagator.Prop",
 	HandlerType: (*PropServer)(nil),
@@ -230,6 +339,173 @@ var _Prop_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Rm",
 			Handler:    _Prop_Rm_Handler,
 		},
+		{
+			MethodName: "List",
+			Handler:    _Prop_List_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{},
 }
+
+// Client API for Admin service
+
+type AdminClient interface {
+	// Export streams the records under path as a versioned NDJSON archive.
+	Export(ctx context.Context, in *ExportReq, opts ...grpc.CallOption) (Admin_ExportClient, error)
+	// Import reads an archive made by Export. Only the first message
+	// needs the options, the archive is split across the data fields.
+	Import(ctx context.Context, opts ...grpc.CallOption) (Admin_ImportClient, error)
+}
+
+type adminClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAdminClient(cc *grpc.ClientConn) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) Export(ctx context.Context, in *ExportReq, opts ...grpc.CallOption) (Admin_ExportClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Admin_serviceDesc.Streams[0], c.cc, "/propagator.Admin/Export", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &adminExportClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Admin_ExportClient interface {
+	Recv() (*Chunk, error)
+	grpc.ClientStream
+}
+
+type adminExportClient struct {
+	grpc.ClientStream
+}
+
+func (x *adminExportClient) Recv() (*Chunk, error) {
+	m := new(Chunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *adminClient) Import(ctx context.Context, opts ...grpc.CallOption) (Admin_ImportClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Admin_serviceDesc.Streams[1], c.cc, "/propagator.Admin/Import", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &adminImportClient{stream}
+	return x, nil
+}
+
+type Admin_ImportClient interface {
+	Send(*ImportReq) error
+	CloseAndRecv() (*ImportRes, error)
+	grpc.ClientStream
+}
+
+type adminImportClient struct {
+	grpc.ClientStream
+}
+
+func (x *adminImportClient) Send(m *ImportReq) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *adminImportClient) CloseAndRecv() (*ImportRes, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ImportRes)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for Admin service
+
+type AdminServer interface {
+	// Export streams the records under path as a versioned NDJSON archive.
+	Export(*ExportReq, Admin_ExportServer) error
+	// Import reads an archive made by Export. Only the first message
+	// needs the options, the archive is split across the data fields.
+	Import(Admin_ImportServer) error
+}
+
+func RegisterAdminServer(s *grpc.Server, srv AdminServer) {
+	s.RegisterService(&_Admin_serviceDesc, srv)
+}
+
+func _Admin_Export_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportReq)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AdminServer).Export(m, &adminExportServer{stream})
+}
+
+type Admin_ExportServer interface {
+	Send(*Chunk) error
+	grpc.ServerStream
+}
+
+type adminExportServer struct {
+	grpc.ServerStream
+}
+
+func (x *adminExportServer) Send(m *Chunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Admin_Import_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AdminServer).Import(&adminImportServer{stream})
+}
+
+type Admin_ImportServer interface {
+	SendAndClose(*ImportRes) error
+	Recv() (*ImportReq, error)
+	grpc.ServerStream
+}
+
+type adminImportServer struct {
+	grpc.ServerStream
+}
+
+func (x *adminImportServer) SendAndClose(m *ImportRes) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *adminImportServer) Recv() (*ImportReq, error) {
+	m := new(ImportReq)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Admin_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "propagator.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Export",
+			Handler:       _Admin_Export_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Import",
+			Handler:       _Admin_Import_Handler,
+			ClientStreams: true,
+		},
+	},
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// recordColumns are the columns scanned by scanRecord, in order.
+// fold_path is NULL for the rows created before the column existed.
+const recordColumns = "id, path, COALESCE(fold_path, ''), checksum, e_tag, m_time"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRecord(sc scanner, r *record) error {
+	return sc.Scan(&r.ID, &r.Path, &r.FoldPath, &r.Checksum, &r.ETag, &r.MTime)
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+// Like database/sql, it uses the standard library context, which the
+// golang.org/x/net/context contexts of the handlers satisfy.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// maxExecutionTimeHint returns an optimizer hint that makes MySQL abort a
+// SELECT when the deadline of ctx passes. The driver cannot cancel running
+// queries, so without it a cancelled request keeps its connection busy.
+func maxExecutionTimeHint(ctx context.Context) string {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ""
+	}
+
+	ms := time.Until(deadline) / time.Millisecond
+	if ms < 1 {
+		ms = 1
+	}
+	return fmt.Sprintf("/*+ MAX_EXECUTION_TIME(%d) */ ", ms)
+}
+
+// queryRecords returns the records matching where, bound to ctx.
+func queryRecords(ctx context.Context, q queryer, where string, args ...interface{}) ([]record, error) {
+	recs := []record{}
+	err := eachRecord(ctx, q, where, func(r *record) error {
+		recs = append(recs, *r)
+		return nil
+	}, args...)
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// eachRecord calls f with every record matching where as it is read,
+// so large results are not held in memory. It stops at the first
+// error returned by f.
+func eachRecord(ctx context.Context, q queryer, where string, f func(r *record) error, args ...interface{}) error {
+
+	query := "SELECT " + maxExecutionTimeHint(ctx) + recordColumns + " FROM records WHERE " + where
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := record{}
+		if err := scanRecord(rows, &r); err != nil {
+			return err
+		}
+		if err := f(&r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// queryRecord returns the first record matching where or
+// gorm.RecordNotFound, like gorm's First does.
+func queryRecord(ctx context.Context, q queryer, where string, args ...interface{}) (*record, error) {
+
+	recs, err := queryRecords(ctx, q, where+" LIMIT 1", args...)
+	if err != nil {
+		return &record{}, err
+	}
+	if len(recs) == 0 {
+		return &record{}, gorm.RecordNotFound
+	}
+	return &recs[0], nil
+}
+
+// likeEscape is the escape character of the LIKE patterns built by
+// likePrefix. Backslash is avoided as its meaning depends on the
+// NO_BACKSLASH_ESCAPES SQL mode.
+const likeEscape = "!"
+
+// likePrefix returns a LIKE pattern, to be used with ESCAPE likeEscape,
+// matching the strings starting with prefix.
+func likePrefix(prefix string) string {
+	r := strings.NewReplacer(likeEscape, likeEscape+likeEscape, "%", likeEscape+"%", "_", likeEscape+"_")
+	return r.Replace(prefix) + "%"
+}
+
+// placeholders returns n comma separated query placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLimitsKey holds the limits of the methods without their own.
+const defaultLimitsKey = "*"
+
+// idleBucketsCleanup is how often buckets of identities that have been
+// idle long enough to be full again are dropped.
+const idleBucketsCleanup = time.Minute
+
+// methodLimits are the limits applied to each identity for a method.
+// Zero values disable the corresponding limit.
+type methodLimits struct {
+	// Rate is the number of requests per second and Burst
+	// the number of requests that can be made at once.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+
+	// MaxInFlight is the number of requests served at the same time.
+	MaxInFlight int `yaml:"inflight"`
+}
+
+// parseLimits parses a comma separated list of method=rate:burst:inflight
+// entries, e.g. "get=100:200:10,put=20:20:5,*=50:50:10".
+func parseLimits(s string) (map[string]methodLimits, error) {
+	limits := map[string]methodLimits{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		values := strings.Split(kv[len(kv)-1], ":")
+		if len(kv) != 2 || len(values) != 3 {
+			return nil, fmt.Errorf("invalid limit %q, expected method=rate:burst:inflight", entry)
+		}
+
+		l := methodLimits{}
+		var err error
+		if l.Rate, err = strconv.ParseFloat(values[0], 64); err != nil {
+			return nil, fmt.Errorf("invalid rate in %q: %s", entry, err)
+		}
+		if l.Burst, err = strconv.Atoi(values[1]); err != nil {
+			return nil, fmt.Errorf("invalid burst in %q: %s", entry, err)
+		}
+		if l.MaxInFlight, err = strconv.Atoi(values[2]); err != nil {
+			return nil, fmt.Errorf("invalid inflight in %q: %s", entry, err)
+		}
+		if l.Rate < 0 || l.Burst < 0 || l.MaxInFlight < 0 {
+			return nil, fmt.Errorf("invalid limit %q, values cannot be negative", entry)
+		}
+		limits[strings.ToLower(strings.TrimSpace(kv[0]))] = l
+	}
+	return limits, nil
+}
+
+// capacity is the size of the token bucket, at least one request.
+func (ml methodLimits) capacity() float64 {
+	if ml.Burst < 1 {
+		return 1
+	}
+	return float64(ml.Burst)
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter enforces per identity rate limits and in flight caps.
+type limiter struct {
+	mu       sync.Mutex
+	limits   map[string]methodLimits
+	buckets  map[string]*bucket
+	inFlight map[string]int
+	cleaned  time.Time
+}
+
+func newLimiter(limits map[string]methodLimits) *limiter {
+	l := &limiter{}
+	l.limits = limits
+	l.buckets = map[string]*bucket{}
+	l.inFlight = map[string]int{}
+	l.cleaned = time.Now()
+	return l
+}
+
+// setLimits replaces the limits. Current buckets are kept.
+func (l *limiter) setLimits(limits map[string]methodLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+func (l *limiter) limitsFor(method string) methodLimits {
+	if ml, ok := l.limits[method]; ok {
+		return ml
+	}
+	return l.limits[defaultLimitsKey]
+}
+
+// acquire admits a request of pid for method. When admitted, release
+// must be called once the request is done. Otherwise retryAfter is
+// the time after which the request may be admitted.
+func (l *limiter) acquire(method, pid string) (release func(), retryAfter time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.cleanup(now)
+
+	ml := l.limitsFor(method)
+	if ml.Rate <= 0 && ml.MaxInFlight <= 0 {
+		return func() {}, 0, true
+	}
+	key := method + "/" + pid
+
+	if ml.MaxInFlight > 0 && l.inFlight[key] >= ml.MaxInFlight {
+		// we cannot know when a request finishes, a second is a
+		// reasonable hint for the RPCs of this service.
+		return nil, time.Second, false
+	}
+
+	if ml.Rate > 0 {
+		b, found := l.buckets[key]
+		if !found {
+			b = &bucket{tokens: ml.capacity(), last: now}
+			l.buckets[key] = b
+		}
+
+		b.tokens += now.Sub(b.last).Seconds() * ml.Rate
+		if b.tokens > ml.capacity() {
+			b.tokens = ml.capacity()
+		}
+		b.last = now
+
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / ml.Rate * float64(time.Second))
+			return nil, wait, false
+		}
+		b.tokens--
+	}
+
+	l.inFlight[key]++
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.inFlight[key]--
+			if l.inFlight[key] <= 0 {
+				delete(l.inFlight, key)
+			}
+		})
+	}
+	return release, 0, true
+}
+
+// cleanup drops the buckets that are full again, as they behave
+// exactly as new ones. It must be called with l.mu held.
+func (l *limiter) cleanup(now time.Time) {
+	if now.Sub(l.cleaned) < idleBucketsCleanup {
+		return
+	}
+	l.cleaned = now
+
+	for key, b := range l.buckets {
+		method := key[:strings.Index(key, "/")]
+		ml := l.limitsFor(method)
+		if ml.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*ml.Rate >= ml.capacity() {
+			delete(l.buckets, key)
+		}
+	}
+}
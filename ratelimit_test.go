@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		s      string
+		limits map[string]methodLimits
+		ok     bool
+	}{
+		{"", map[string]methodLimits{}, true},
+		{"get=100:200:10, PUT=0.5:1:0,*=50:50:10,", map[string]methodLimits{
+			"get": {100, 200, 10},
+			"put": {0.5, 1, 0},
+			"*":   {50, 50, 10},
+		}, true},
+		{"get=100:200", nil, false},
+		{"100:200:10", nil, false},
+		{"get=fast:1:1", nil, false},
+		{"get=1:1.5:1", nil, false},
+		{"get=1:1:x", nil, false},
+		{"get=-1:1:1", nil, false},
+		{"get=1:1:-1", nil, false},
+	}
+	for _, tt := range tests {
+		limits, err := parseLimits(tt.s)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("parseLimits(%q): %v, want ok %t", tt.s, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(limits, tt.limits) {
+			t.Errorf("parseLimits(%q) = %v, want %v", tt.s, limits, tt.limits)
+		}
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := newLimiter(map[string]methodLimits{"get": {Rate: 10, Burst: 2}})
+
+	for i := 0; i < 2; i++ {
+		release, _, ok := l.acquire("get", "demo")
+		if !ok {
+			t.Fatalf("request %d of the burst rejected", i)
+		}
+		release()
+	}
+	_, retryAfter, ok := l.acquire("get", "demo")
+	if ok {
+		t.Fatal("request over the burst admitted")
+	}
+	if retryAfter <= 0 || retryAfter > 100*time.Millisecond {
+		t.Errorf("retry after %s, want at most the 100ms of a token", retryAfter)
+	}
+
+	// buckets are per identity and method
+	if _, _, ok := l.acquire("get", "other"); !ok {
+		t.Error("request of another identity rejected")
+	}
+	if _, _, ok := l.acquire("put", "demo"); !ok {
+		t.Error("request of an unlimited method rejected")
+	}
+
+	// a token is back after 1/rate
+	l.mu.Lock()
+	l.buckets["get/demo"].last = time.Now().Add(-100 * time.Millisecond)
+	l.mu.Unlock()
+	if _, _, ok := l.acquire("get", "demo"); !ok {
+		t.Error("request rejected after the bucket refilled")
+	}
+	if _, _, ok := l.acquire("get", "demo"); ok {
+		t.Error("refill exceeded the elapsed time")
+	}
+}
+
+func TestLimiterInFlight(t *testing.T) {
+	l := newLimiter(map[string]methodLimits{"*": {MaxInFlight: 1}})
+
+	release, _, ok := l.acquire("mv", "demo")
+	if !ok {
+		t.Fatal("first request rejected")
+	}
+	if _, retryAfter, ok := l.acquire("mv", "demo"); ok || retryAfter != time.Second {
+		t.Fatalf("request over the cap: ok %t, retry after %s", ok, retryAfter)
+	}
+	release()
+	// releasing twice must not free a second slot
+	release()
+	release2, _, ok := l.acquire("mv", "demo")
+	if !ok {
+		t.Fatal("request rejected after the release")
+	}
+	if _, _, ok := l.acquire("mv", "demo"); ok {
+		t.Error("double release freed a second slot")
+	}
+	release2()
+	if len(l.inFlight) != 0 {
+		t.Errorf("%d in flight counters left", len(l.inFlight))
+	}
+}
+
+func TestLimiterSetLimitsAndCleanup(t *testing.T) {
+	l := newLimiter(map[string]methodLimits{"get": {Rate: 1, Burst: 1}})
+	if _, _, ok := l.acquire("get", "demo"); !ok {
+		t.Fatal("first request rejected")
+	}
+	if _, _, ok := l.acquire("get", "demo"); ok {
+		t.Fatal("request over the burst admitted")
+	}
+
+	l.setLimits(map[string]methodLimits{})
+	if _, _, ok := l.acquire("get", "demo"); !ok {
+		t.Fatal("request rejected once the limits were removed")
+	}
+
+	l.setLimits(map[string]methodLimits{"get": {Rate: 1, Burst: 1}})
+	l.mu.Lock()
+	l.buckets["get/demo"].last = time.Now().Add(-time.Minute)
+	l.cleaned = time.Now().Add(-2 * idleBucketsCleanup)
+	l.mu.Unlock()
+	if _, _, ok := l.acquire("get", "other"); !ok {
+		t.Fatal("request of another identity rejected")
+	}
+	if _, found := l.buckets["get/demo"]; found {
+		t.Error("full bucket of an idle identity not dropped")
+	}
+}
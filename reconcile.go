@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/nu7hatch/gouuid"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"hash"
+	"hash/adler32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reconcileOptions select what reconcile compares and whether it fixes
+// the differences found.
+type reconcileOptions struct {
+	// root is the local directory holding the files of prefix.
+	root   string
+	prefix string
+
+	// checksum compares the checksums of the files whose record has one
+	// in the algorithm:hex form, e.g. SHA1:2fd4e1c6...
+	checksum bool
+	dryRun   bool
+}
+
+// reconcileReport lists the differences found by reconcile.
+type reconcileReport struct {
+	missing  []string
+	stale    []string
+	orphaned []string
+	invalid  []string
+	// propagated is the number of paths changes were propagated from.
+	propagated int
+}
+
+func (r *reconcileReport) print(w io.Writer, dryRun bool) {
+	for _, paths := range [][]string{r.missing, r.stale, r.orphaned, r.invalid} {
+		sort.Strings(paths)
+	}
+	for _, p := range r.missing {
+		fmt.Fprintf(w, "missing  %s\n", p)
+	}
+	for _, p := range r.stale {
+		fmt.Fprintf(w, "stale    %s\n", p)
+	}
+	for _, p := range r.orphaned {
+		fmt.Fprintf(w, "orphaned %s\n", p)
+	}
+	for _, p := range r.invalid {
+		fmt.Fprintf(w, "invalid  %s\n", p)
+	}
+
+	fmt.Fprintf(w, "%d missing, %d stale, %d orphaned, %d invalid\n",
+		len(r.missing), len(r.stale), len(r.orphaned), len(r.invalid))
+	if dryRun {
+		fmt.Fprintln(w, "dry run, nothing changed")
+		return
+	}
+	fmt.Fprintf(w, "records fixed, changes propagated from %d paths\n", r.propagated)
+}
+
+func reconcileCommand(args []string) error {
+	fs, cf := newCommandFlags("reconcile", "-root <dir> [-prefix <path>] [-checksum] [-dry-run]")
+	opts := &reconcileOptions{}
+	fs.StringVar(&opts.root, "root", "", "local directory to compare the records with")
+	fs.StringVar(&opts.prefix, "prefix", "/", "path of the records stored under root")
+	fs.BoolVar(&opts.checksum, "checksum", false, "also compare file checksums, slower")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "only report the differences")
+	fs.Parse(args)
+
+	if opts.root == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s, err := newCommandServer(cf)
+	if err != nil {
+		return err
+	}
+
+	report, err := s.reconcile(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	report.print(os.Stdout, opts.dryRun)
+	return nil
+}
+
+// reconcile compares the files under opts.root with the records under
+// opts.prefix and, unless it is a dry run, makes the records match the
+// files: missing records are created, stale ones updated and orphaned
+// ones removed. Changes are then propagated to the ancestors.
+//
+// Records are considered stale when the file was modified after the
+// record, as records store when the service saw the last change.
+// Fixed records get the current time for their changes to propagate.
+func (s *server) reconcile(ctx context.Context, opts *reconcileOptions) (*reconcileReport, error) {
+
+	traceID, err := getGRPCTraceID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
+	ctx = newGRPCTraceContext(ctx, traceID)
+
+	prefix, err := s.paths.canonical(opts.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	recs, err := s.getDescendants(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := s.getByPath(ctx, prefix)
+	if err != nil && err != gorm.RecordNotFound {
+		return nil, err
+	}
+	if err == nil {
+		recs = append(recs, *rec)
+	}
+
+	byKey := map[string]*record{}
+	for i := range recs {
+		byKey[s.pathKey(recs[i].Path)] = &recs[i]
+	}
+	log.Infof("%d records under %s", len(recs), prefix)
+
+	report := &reconcileReport{}
+	// file names by path, they differ if paths are normalized
+	missing := map[string]string{}
+	stale := map[string]string{}
+	seen := map[string]bool{}
+
+	err = filepath.Walk(opts.root, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// symlinks and special files are not served by the storage
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(opts.root, name)
+		if err != nil {
+			return err
+		}
+		p, err := s.paths.canonical(path.Join(prefix, filepath.ToSlash(rel)))
+		if err != nil {
+			report.invalid = append(report.invalid, fmt.Sprintf("%s: %s", name, err))
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		key := s.pathKey(p)
+		seen[key] = true
+		rec, ok := byKey[key]
+		if !ok {
+			report.missing = append(report.missing, p)
+			missing[p] = name
+			return nil
+		}
+
+		// directories are as new as their newest descendant, which
+		// their mtime on disk does not tell
+		if fi.IsDir() {
+			return nil
+		}
+
+		if int64(rec.MTime) < fi.ModTime().Unix() {
+			report.stale = append(report.stale, p+" (mtime)")
+			stale[rec.Path] = rec.Checksum
+			return nil
+		}
+		if opts.checksum {
+			sum, err := fileChecksum(name, rec.Checksum)
+			if err != nil {
+				return err
+			}
+			if sum != "" && !strings.EqualFold(sum, rec.Checksum) {
+				report.stale = append(report.stale, p+" (checksum)")
+				stale[rec.Path] = sum
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	orphaned := []*record{}
+	for key, rec := range byKey {
+		if !seen[key] {
+			report.orphaned = append(report.orphaned, rec.Path)
+			orphaned = append(orphaned, rec)
+		}
+	}
+
+	if opts.dryRun {
+		return report, nil
+	}
+
+	rawEtag, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	etag := rawEtag.String()
+	mtime := uint32(time.Now().Unix())
+
+	changed := []string{}
+	for p, name := range missing {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return nil, err
+		}
+		checksum := ""
+		if fi, err := os.Stat(name); err == nil && opts.checksum && fi.Mode().IsRegular() {
+			// without a record to tell the algorithm SHA1 is used,
+			// as ownCloud clients do
+			if checksum, err = fileChecksum(name, "SHA1:"); err != nil {
+				return nil, err
+			}
+		}
+		if s.tree {
+			err = s.treePut(ctx, id.String(), p, checksum, etag, mtime)
+		} else {
+			err = s.insert(ctx, id.String(), p, s.paths.fold(p), checksum, etag, mtime)
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("record of %s created", p)
+		changed = append(changed, p)
+	}
+	for p, checksum := range stale {
+		var err error
+		if s.tree {
+			_, err = s.db.DB().ExecContext(ctx, "UPDATE nodes SET checksum=?, e_tag=?, m_time=? WHERE id=?", checksum, etag, mtime, byKey[s.pathKey(p)].ID)
+		} else {
+			_, err = s.db.DB().ExecContext(ctx, "UPDATE records SET checksum=?, e_tag=?, m_time=? WHERE path=?", checksum, etag, mtime, p)
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("record of %s updated", p)
+		changed = append(changed, p)
+	}
+	for _, rec := range orphaned {
+		var err error
+		if s.tree {
+			// the descendants of an orphaned node are orphaned too
+			err = s.treeRemove(ctx, rec.Path, time.Now().Unix())
+		} else {
+			_, err = s.db.DB().ExecContext(ctx, "DELETE FROM records WHERE id=? AND path=?", rec.ID, rec.Path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("orphaned record of %s removed", rec.Path)
+		changed = append(changed, rec.Path)
+	}
+
+	// ancestors shared by several paths are only updated once
+	// as they all use the same mtime
+	for _, p := range changed {
+		if err := s.propagateChanges(ctx, p, etag, mtime, ""); err != nil {
+			return nil, err
+		}
+	}
+	report.propagated = len(changed)
+
+	return report, nil
+}
+
+// pathKey returns the key identifying the record of p, which in a
+// case insensitive namespace is the same for all the cases of p.
+func (s *server) pathKey(p string) string {
+	if s.paths.caseInsensitive {
+		return s.paths.fold(p)
+	}
+	return p
+}
+
+// fileChecksum returns the checksum of the file name in the same
+// algorithm:hex form as like, or an empty string if like does not
+// name a known algorithm.
+func fileChecksum(name, like string) (string, error) {
+	i := strings.Index(like, ":")
+	if i < 0 {
+		return "", nil
+	}
+	algorithm := like[:i]
+
+	var h hash.Hash
+	switch strings.ToUpper(algorithm) {
+	case "MD5":
+		h = md5.New()
+	case "SHA1":
+		h = sha1.New()
+	case "SHA256":
+		h = sha256.New()
+	case "ADLER32":
+		h = adler32.New()
+	default:
+		return "", nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
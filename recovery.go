@@ -0,0 +1,114 @@
+package main
+
+import (
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"runtime/debug"
+)
+
+var internalError = grpc.Errorf(codes.Internal, "internal error")
+
+// recoveryServer wraps a PropServer and an AdminServer and converts
+// any panic raised while serving a request into a codes.Internal error,
+// so a faulty request does not take down the whole service.
+type recoveryServer struct {
+	srv   pb.PropServer
+	admin pb.AdminServer
+}
+
+func newRecoveryServer(srv pb.PropServer, admin pb.AdminServer) *recoveryServer {
+	return &recoveryServer{srv: srv, admin: admin}
+}
+
+func (s *recoveryServer) Get(ctx context.Context, req *pb.GetReq) (res *pb.Record, err error) {
+	ctx, traceID := s.traceContext(ctx)
+	defer s.recover(traceID, "get", &err)
+	return s.srv.Get(ctx, req)
+}
+
+func (s *recoveryServer) Put(ctx context.Context, req *pb.PutReq) (res *pb.Void, err error) {
+	ctx, traceID := s.traceContext(ctx)
+	defer s.recover(traceID, "put", &err)
+	return s.srv.Put(ctx, req)
+}
+
+func (s *recoveryServer) Mv(ctx context.Context, req *pb.MvReq) (res *pb.Void, err error) {
+	ctx, traceID := s.traceContext(ctx)
+	defer s.recover(traceID, "mv", &err)
+	return s.srv.Mv(ctx, req)
+}
+
+func (s *recoveryServer) Rm(ctx context.Context, req *pb.RmReq) (res *pb.Void, err error) {
+	ctx, traceID := s.traceContext(ctx)
+	defer s.recover(traceID, "rm", &err)
+	return s.srv.Rm(ctx, req)
+}
+
+func (s *recoveryServer) List(ctx context.Context, req *pb.ListReq) (res *pb.Records, err error) {
+	ctx, traceID := s.traceContext(ctx)
+	defer s.recover(traceID, "list", &err)
+	return s.srv.List(ctx, req)
+}
+
+func (s *recoveryServer) Export(req *pb.ExportReq, stream pb.Admin_ExportServer) (err error) {
+	ctx, traceID := s.traceContext(stream.Context())
+	defer s.recover(traceID, "export", &err)
+	return s.admin.Export(req, &exportStream{stream, ctx})
+}
+
+func (s *recoveryServer) Import(stream pb.Admin_ImportServer) (err error) {
+	ctx, traceID := s.traceContext(stream.Context())
+	defer s.recover(traceID, "import", &err)
+	return s.admin.Import(&importStream{stream, ctx})
+}
+
+// exportStream and importStream carry the context with the
+// trace ID resolved by traceContext.
+type exportStream struct {
+	pb.Admin_ExportServer
+	ctx context.Context
+}
+
+func (s *exportStream) Context() context.Context {
+	return s.ctx
+}
+
+type importStream struct {
+	pb.Admin_ImportServer
+	ctx context.Context
+}
+
+func (s *importStream) Context() context.Context {
+	return s.ctx
+}
+
+// traceContext resolves the trace ID before calling the wrapped server
+// so the ID logged on panic is the same one the handler logs with.
+func (s *recoveryServer) traceContext(ctx context.Context) (context.Context, string) {
+	traceID, err := getGRPCTraceID(ctx)
+	if err != nil {
+		rus.Error(err)
+		return ctx, ""
+	}
+	return newGRPCTraceContext(ctx, traceID), traceID
+}
+
+func (s *recoveryServer) recover(traceID, method string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	panicsCounter.Add(1)
+
+	rus.WithField("trace", traceID).WithField("svc", serviceID).WithFields(rus.Fields{
+		"method": method,
+		"panic":  r,
+		"stack":  string(debug.Stack()),
+	}).Error("recovered from panic")
+
+	*err = internalError
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadable are the configuration keys applied without a restart.
+// Changes to any other key are logged and ignored until the next one.
+var reloadable = map[string]bool{
+	"log_level":           true,
+	"max_sql_idle":        true,
+	"max_sql_concurrency": true,
+	"home_depth":          true,
+	"rate_limits":         true,
+	"timeouts":            true,
+	"admin_users":         true,
+}
+
+// runtimeSettings are the settings of the server that can be
+// reloaded. They are replaced as a whole so requests never see
+// a mix of old and new values.
+type runtimeSettings struct {
+	homeDepth  int
+	timeouts   map[string]time.Duration
+	adminUsers map[string]bool
+}
+
+func newRuntimeSettings(homeDepth int, timeouts map[string]time.Duration, adminUsers []string) *runtimeSettings {
+	rs := &runtimeSettings{}
+	rs.homeDepth = homeDepth
+	rs.timeouts = timeouts
+	rs.adminUsers = map[string]bool{}
+	for _, pid := range adminUsers {
+		rs.adminUsers[pid] = true
+	}
+	return rs
+}
+
+func (s *server) getRuntime() *runtimeSettings {
+	return s.runtime.Load().(*runtimeSettings)
+}
+
+func (s *server) setRuntime(rs *runtimeSettings) {
+	s.runtime.Store(rs)
+}
+
+// applyConfig applies the reloadable settings of c.
+// c must have been validated.
+func (s *server) applyConfig(c *config) {
+	setLogLevel(c)
+
+	// open first, idle connections are capped by open ones
+	s.db.DB().SetMaxOpenConns(c.MaxSQLConcurrency)
+	s.db.DB().SetMaxIdleConns(c.MaxSQLIdle)
+	s.replicas.setPoolSizes(c.MaxSQLIdle, c.MaxSQLConcurrency)
+
+	s.lockWait.setTimeout(lockWaitTimeout(c.Timeouts))
+	s.limits.setLimits(c.RateLimits)
+	s.setRuntime(newRuntimeSettings(c.HomeDepth, c.Timeouts, c.AdminUsers))
+}
+
+// reloader reloads the configuration of a running server.
+type reloader struct {
+	mu      sync.Mutex
+	cf      *configFlags
+	current *config
+	srv     *server
+}
+
+func newReloader(cf *configFlags, current *config, srv *server) *reloader {
+	r := &reloader{}
+	r.cf = cf
+	r.current = current
+	r.srv = srv
+	return r
+}
+
+// watch reloads the configuration on every SIGHUP.
+func (r *reloader) watch() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		log.Info("SIGHUP received, reloading configuration")
+		if err := r.reload(); err != nil {
+			log.Errorf("configuration not reloaded, keeping the current one: %s", err)
+		}
+	}
+}
+
+// reload reads the configuration again from the same sources used
+// at start up. An invalid configuration is rejected as a whole.
+// The cached records are dropped in any case, as they may predate
+// changes made by the maintenance subcommands.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.srv.records.purge()
+
+	c, err := r.cf.load()
+	if err != nil {
+		return err
+	}
+
+	changes, err := diffConfig(r.current, c)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		log.Info("configuration reloaded, nothing changed")
+		return nil
+	}
+
+	// the settings needing a restart keep their running values
+	applied := *r.current
+	for _, ch := range changes {
+		if !reloadable[ch.key] {
+			log.Warnf("configuration change needs a restart, ignored: %s", ch)
+			continue
+		}
+		log.Infof("configuration changed: %s", ch)
+	}
+	applied.LogLevel = c.LogLevel
+	applied.MaxSQLIdle = c.MaxSQLIdle
+	applied.MaxSQLConcurrency = c.MaxSQLConcurrency
+	applied.HomeDepth = c.HomeDepth
+	applied.RateLimits = c.RateLimits
+	applied.Timeouts = c.Timeouts
+	applied.AdminUsers = c.AdminUsers
+
+	r.srv.applyConfig(&applied)
+	r.current = &applied
+	return nil
+}
+
+// configChange is a setting whose value differs between two configurations.
+type configChange struct {
+	key      string
+	old, new interface{}
+}
+
+func (ch configChange) String() string {
+	return fmt.Sprintf("%s: %v -> %v", ch.key, ch.old, ch.new)
+}
+
+// diffConfig returns the settings changed from old to new, sorted by
+// key. Secrets are redacted so the changes are safe to log.
+func diffConfig(old, new *config) ([]configChange, error) {
+	oldValues, err := configValues(old)
+	if err != nil {
+		return nil, err
+	}
+	newValues, err := configValues(new)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for k := range oldValues {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	changes := []configChange{}
+	for _, k := range keys {
+		changed := !reflect.DeepEqual(oldValues[k], newValues[k])
+		// changed secrets are redacted the same way, compare them apart
+		switch k {
+		case "shared_secret":
+			changed = old.SharedSecret != new.SharedSecret
+		case "dsn":
+			changed = old.DSN != new.DSN
+		}
+		if changed {
+			changes = append(changes, configChange{k, oldValues[k], newValues[k]})
+		}
+	}
+	return changes, nil
+}
+
+// configValues returns the redacted settings of c by configuration key.
+func configValues(c *config) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(c.redacted())
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultReadYourWritesWindow is how long the reads of a caller
+	// go to the primary after the caller changed something.
+	defaultReadYourWritesWindow = 5 * time.Second
+
+	// replicaCheckInterval is how often the replicas are pinged.
+	replicaCheckInterval = 5 * time.Second
+
+	// replicaCheckTimeout bounds each ping.
+	replicaCheckTimeout = 2 * time.Second
+
+	// replicaWritersSize is the number of recent writers remembered
+	// for read-your-writes.
+	replicaWritersSize = 100000
+)
+
+// replica is a read-only copy of the primary database.
+type replica struct {
+	name string
+	db   *gorm.DB
+	// healthy is 1 while the last ping succeeded
+	healthy int32
+}
+
+// replicaSet routes the reads of the read-only RPCs to the healthy
+// replicas in turn. Reads fall back to the primary when no replica is
+// healthy and, for read-your-writes, when the caller changed something
+// in the last window, as replicas may lag behind the primary.
+type replicaSet struct {
+	replicas []*replica
+	next     uint32
+	window   time.Duration
+	// writers holds the pids that wrote in the last window,
+	// nil if read-your-writes is disabled
+	writers *lru
+}
+
+// newReplicaSet opens the replicas in dsns and checks them once.
+func newReplicaSet(dsns []string, maxIdle, maxOpen int, window time.Duration) (*replicaSet, error) {
+	rs := &replicaSet{}
+	rs.window = window
+	if window > 0 {
+		rs.writers = newLRU(replicaWritersSize)
+	}
+
+	for _, dsn := range dsns {
+		db, err := newDB("mysql", dsn)
+		if err != nil {
+			return nil, err
+		}
+
+		r := &replica{}
+		r.name = dsnPassword.ReplaceAllString(dsn, "${1}:"+redacted+"@")
+		r.db = db
+		rs.replicas = append(rs.replicas, r)
+	}
+	rs.setPoolSizes(maxIdle, maxOpen)
+	rs.check()
+	return rs, nil
+}
+
+// setPoolSizes sets the connection pool sizes of every replica, as
+// they are for the primary.
+func (rs *replicaSet) setPoolSizes(maxIdle, maxOpen int) {
+	for _, r := range rs.replicas {
+		// open first, idle connections are capped by open ones
+		r.db.DB().SetMaxOpenConns(maxOpen)
+		r.db.DB().SetMaxIdleConns(maxIdle)
+	}
+}
+
+// check pings every replica and updates its health.
+func (rs *replicaSet) check() {
+	for _, r := range rs.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+		err := r.db.DB().PingContext(ctx)
+		cancel()
+
+		healthy := int32(1)
+		if err != nil {
+			healthy = 0
+		}
+		if atomic.SwapInt32(&r.healthy, healthy) != healthy {
+			if err != nil {
+				rus.Warnf("replica %s is unhealthy, its reads go to the primary: %s", r.name, err)
+			} else {
+				rus.Infof("replica %s is healthy", r.name)
+			}
+		}
+	}
+}
+
+// watch checks the replicas every interval, forever.
+func (rs *replicaSet) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		rs.check()
+	}
+}
+
+// wrote remembers that pid changed something, so that its reads
+// go to the primary for the window.
+func (rs *replicaSet) wrote(pid string) {
+	if rs.writers == nil || len(rs.replicas) == 0 {
+		return
+	}
+	rs.writers.add(pid, true, time.Now().Add(rs.window))
+}
+
+// pick returns the replica the reads of pid go to, nil for the primary.
+func (rs *replicaSet) pick(pid string) *replica {
+	if len(rs.replicas) == 0 {
+		return nil
+	}
+	if rs.writers != nil {
+		if _, ok := rs.writers.get(pid); ok {
+			return nil
+		}
+	}
+
+	start := atomic.AddUint32(&rs.next, 1)
+	for i := range rs.replicas {
+		r := rs.replicas[(int(start)+i)%len(rs.replicas)]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			replicaReadsCounter.Add(1)
+			return r
+		}
+	}
+	replicaFallbacksCounter.Add(1)
+	return nil
+}
+
+type readDBKey struct{}
+
+// withReplica returns a context whose reads go to a replica
+// picked for pid, or to the primary.
+func (s *server) withReplica(ctx context.Context, pid string) context.Context {
+	r := s.replicas.pick(pid)
+	if r == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, readDBKey{}, r)
+}
+
+// readDB returns the database the reads of ctx go to.
+func (s *server) readDB(ctx context.Context) *sql.DB {
+	if r, ok := ctx.Value(readDBKey{}).(*replica); ok {
+		return r.db.DB()
+	}
+	return s.db.DB()
+}
+
+// fromReplica tells if the reads of ctx go to a replica.
+func fromReplica(ctx context.Context) bool {
+	_, ok := ctx.Value(readDBKey{}).(*replica)
+	return ok
+}
+
+// replicaFailed tells if err is a connection error of the replica
+// the reads of ctx went to, in which case the reads are to be done
+// again on the primary. The replica is marked unhealthy until the
+// next check finds it healthy, so the following reads do not wait on
+// it as well.
+func replicaFailed(ctx context.Context, err error) bool {
+	r, ok := ctx.Value(readDBKey{}).(*replica)
+	if !ok || !isConnError(err) {
+		return false
+	}
+	if atomic.SwapInt32(&r.healthy, 0) == 1 {
+		rus.Warnf("replica %s is unhealthy, its reads go to the primary: %s", r.name, err)
+	}
+	replicaFallbacksCounter.Add(1)
+	return true
+}
+
+// isConnError tells if err comes from the connection to the database
+// rather than from the query.
+func isConnError(err error) bool {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql/driver"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/context"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// unreachableDB returns a database whose connections are refused.
+func unreachableDB(t *testing.T) *gorm.DB {
+	// the failed ping is expected, the database is still returned
+	db, _ := gorm.Open("mysql", "user:pass@tcp(127.0.0.1:1)/prop")
+	if db.DB() == nil {
+		t.Fatal("database not opened")
+	}
+	return &db
+}
+
+func TestIsConnError(t *testing.T) {
+	tests := []struct {
+		err  error
+		conn bool
+	}{
+		{driver.ErrBadConn, true},
+		{mysql.ErrInvalidConn, true},
+		{&net.OpError{Op: "dial", Net: "tcp"}, true},
+		{gorm.RecordNotFound, false},
+		{&mysql.MySQLError{Number: mysqlErrDupEntry}, false},
+		{context.DeadlineExceeded, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if conn := isConnError(tt.err); conn != tt.conn {
+			t.Errorf("isConnError(%v) = %t, want %t", tt.err, conn, tt.conn)
+		}
+	}
+}
+
+func TestReplicaFailed(t *testing.T) {
+	r := &replica{name: "replica", healthy: 1}
+	rs := &replicaSet{replicas: []*replica{r}}
+	ctx := context.WithValue(context.Background(), readDBKey{}, r)
+
+	if replicaFailed(ctx, gorm.RecordNotFound) || atomic.LoadInt32(&r.healthy) != 1 {
+		t.Fatal("replica failed by a missing record")
+	}
+	if replicaFailed(context.Background(), driver.ErrBadConn) {
+		t.Fatal("primary read retried on the primary")
+	}
+	if !replicaFailed(ctx, driver.ErrBadConn) {
+		t.Fatal("connection error of the replica not retried")
+	}
+	// the following reads go to the primary until the next check
+	if atomic.LoadInt32(&r.healthy) != 0 || rs.pick("demo") != nil {
+		t.Error("failed replica still picked")
+	}
+}
+
+func TestReplicaCheck(t *testing.T) {
+	r := &replica{name: "replica", db: unreachableDB(t), healthy: 1}
+	rs := &replicaSet{replicas: []*replica{r}}
+	rs.check()
+	if atomic.LoadInt32(&r.healthy) != 0 {
+		t.Error("unreachable replica healthy")
+	}
+}
+
+func TestReloadedReplicaPoolSizes(t *testing.T) {
+	s := &server{}
+	s.db = unreachableDB(t)
+	s.lockWait = &lockWaitConnector{}
+	s.limits = newLimiter(nil)
+	s.replicas = &replicaSet{replicas: []*replica{{name: "replica", db: unreachableDB(t)}}}
+
+	c := validConfig()
+	c.MaxSQLIdle, c.MaxSQLConcurrency = 3, 7
+	s.applyConfig(c)
+	for name, db := range map[string]*gorm.DB{"primary": s.db, "replica": s.replicas.replicas[0].db} {
+		if n := db.DB().Stats().MaxOpenConnections; n != 7 {
+			t.Errorf("%s pool of %d connections, want 7", name, n)
+		}
+	}
+}
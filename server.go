@@ -1,7 +1,6 @@
 package main
 
 import (
-	"github.com/clawio/service-auth/lib"
 	pb "github.com/clawio/service-localfs-prop/proto/propagator"
 	"github.com/jinzhu/gorm"
 	"github.com/nu7hatch/gouuid"
@@ -11,6 +10,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,7 +24,7 @@ var (
 type debugLogger struct{}
 
 func (*debugLogger) Print(msg ...interface{}) {
-	rus.Debug(msg)
+	rus.Debug(msg...)
 }
 
 type newServerParams struct {
@@ -33,11 +33,27 @@ type newServerParams struct {
 	sharedSecret      string
 	maxSqlIdle        int
 	maxSqlConcurrency int
+	normalization     string
+	caseInsensitive   bool
+	homeDepth         int
+	layout            string
+	recordCacheSize   int
+	recordCacheTTL    time.Duration
+	replicaDSNs       []string
+	readYourWrites    time.Duration
+	jwtAlgorithms     []string
+	jwtPublicKeys     map[string]string
+	jwksFile          string
+	tokenCacheSize    int
+	adminUsers        []string
+	limits            map[string]methodLimits
+	timeouts          map[string]time.Duration
 }
 
 func newServer(p *newServerParams) (*server, error) {
 
-	db, err := newDB("mysql", p.dsn)
+	// writes waiting for row locks give up after the longest timeout
+	db, lockWait, err := newLockWaitDB(mysqlDSN(p.dsn), lockWaitTimeout(p.timeouts))
 	if err != nil {
 		rus.Error(err)
 		return nil, err
@@ -45,26 +61,93 @@ func newServer(p *newServerParams) (*server, error) {
 
 	db.LogMode(true)
 	db.SetLogger(&debugLogger{})
+
+	// pending migrations are applied, a schema newer than
+	// this build understands is refused. The pool is not limited
+	// yet, the migration lock keeps a connection of its own.
+	err = migrateUp(context.Background(), db.DB(), latestSchemaVersion())
+	if err != nil {
+		rus.Error(err)
+		return nil, err
+	}
+
 	db.DB().SetMaxIdleConns(p.maxSqlIdle)
 	db.DB().SetMaxOpenConns(p.maxSqlConcurrency)
 
-	err = db.AutoMigrate(&record{}).Error
+	rus.Infof("schema at version %d", latestSchemaVersion())
+
+	paths, err := newPathPolicy(p.normalization, p.caseInsensitive)
 	if err != nil {
 		rus.Error(err)
 		return nil, err
 	}
 
-	rus.Infof("automigration applied")
+	verifier, err := newTokenVerifier(p.sharedSecret, p.jwtAlgorithms, p.jwtPublicKeys, p.jwksFile, p.tokenCacheSize)
+	if err != nil {
+		rus.Error(err)
+		return nil, err
+	}
 
 	s := &server{}
 	s.p = p
 	s.db = db
+	s.lockWait = lockWait
+	s.paths = paths
+	s.verifier = verifier
+	s.limits = newLimiter(p.limits)
+	s.tree = p.layout == layoutTree
+	s.treeCache = newTreeCache()
+	s.records = newRecordCache(p.recordCacheSize, p.recordCacheTTL)
+
+	s.replicas, err = newReplicaSet(p.replicaDSNs, p.maxSqlIdle, p.maxSqlConcurrency, p.readYourWrites)
+	if err != nil {
+		rus.Error(err)
+		return nil, err
+	}
+	if len(p.replicaDSNs) > 0 {
+		go s.replicas.watch(replicaCheckInterval)
+	}
+	s.setRuntime(newRuntimeSettings(p.homeDepth, p.timeouts, p.adminUsers))
+
+	if paths.caseInsensitive && !s.tree {
+		err = s.backfillFoldPaths()
+		if err != nil {
+			rus.Error(err)
+			return nil, err
+		}
+	}
+
+	if s.tree {
+		err = s.treeKeyNames(context.Background())
+		if err != nil {
+			rus.Error(err)
+			return nil, err
+		}
+	}
+
 	return s, nil
 }
 
 type server struct {
-	p  *newServerParams
-	db *gorm.DB
+	p        *newServerParams
+	db       *gorm.DB
+	lockWait *lockWaitConnector
+	paths    *pathPolicy
+	verifier *tokenVerifier
+	limits   *limiter
+
+	// tree selects the tree layout, whose resolved paths are cached
+	tree      bool
+	treeCache *treeCache
+
+	// records caches the records returned by Get
+	records *recordCache
+
+	// replicas serve the reads of Get and List
+	replicas *replicaSet
+
+	// runtime holds the *runtimeSettings, replaced on reload
+	runtime atomic.Value
 }
 
 func (s *server) Get(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
@@ -72,7 +155,7 @@ func (s *server) Get(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
 	traceID, err := getGRPCTraceID(ctx)
 	if err != nil {
 		rus.Error(err)
-		return &pb.Record{}, err
+		return &pb.Record{}, toGRPCError(ctx, err, "")
 	}
 	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
 	ctx = newGRPCTraceContext(ctx, traceID)
@@ -95,7 +178,7 @@ func (s *server) Get(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
 
 	}()
 
-	idt, err := lib.ParseToken(req.AccessToken, s.p.sharedSecret)
+	idt, _, err := s.authenticate(ctx, &req.AccessToken)
 	if err != nil {
 		log.Error(err)
 		return &pb.Record{}, unauthenticatedError
@@ -103,46 +186,64 @@ func (s *server) Get(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
 
 	log.Infof("%s", idt)
 
-	p := path.Clean(req.Path)
+	release, err := s.limit(ctx, "get", idt)
+	if err != nil {
+		log.Error(err)
+		return &pb.Record{}, err
+	}
+	defer release()
+
+	ctx, cancel := s.withTimeout(ctx, "get")
+	defer cancel()
+
+	p, err := s.paths.canonical(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.Record{}, toGRPCError(ctx, err, "")
+	}
 
 	log.Infof("path is %s", p)
 
 	var rec *record
 
-	rec, err = s.getByPath(p)
+	// the creation below reads and writes the primary
+	readCtx := s.withReplica(ctx, idt.Pid)
+	rec, err = s.getCachedByPath(readCtx, p)
+	if replicaFailed(readCtx, err) {
+		readCtx = ctx
+		rec, err = s.getCachedByPath(ctx, p)
+	}
+	if err == gorm.RecordNotFound && req.ForceCreation && fromReplica(readCtx) {
+		// a lagging replica may miss a record of the primary,
+		// which the creation would overwrite
+		rec, err = s.getCachedByPath(ctx, p)
+	}
 	if err != nil {
 		log.Error(err)
 		if err != gorm.RecordNotFound {
-			return &pb.Record{}, err
+			return &pb.Record{}, toGRPCError(ctx, err, p)
 		}
 
 		if !req.ForceCreation {
-			return &pb.Record{}, err
+			return &pb.Record{}, toGRPCError(ctx, err, p)
 		}
 
-		if req.ForceCreation {
-			in := &pb.PutReq{}
-			in.AccessToken = req.AccessToken
-			in.Path = req.Path
-			_, e := s.Put(ctx, in)
-			if e != nil {
-				return &pb.Record{}, err
-			}
+		// not through Put, the request is already limited as a get
+		err = s.put(ctx, p, "")
+		s.replicas.wrote(idt.Pid)
+		if err != nil {
+			log.Error(err)
+			return &pb.Record{}, toGRPCError(ctx, err, p)
+		}
 
-			rec, err = s.getByPath(p)
-			if err != nil {
-				return &pb.Record{}, nil
-			}
+		rec, err = s.getCachedByPath(ctx, p)
+		if err != nil {
+			log.Error(err)
+			return &pb.Record{}, toGRPCError(ctx, err, p)
 		}
 	}
 
-	r := &pb.Record{}
-	r.Id = rec.ID
-	r.Path = rec.Path
-	r.Etag = rec.ETag
-	r.Modified = rec.MTime
-	r.Checksum = rec.Checksum
-	return r, nil
+	return newPBRecord(rec), nil
 }
 
 func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
@@ -150,11 +251,7 @@ func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
 	traceID, err := getGRPCTraceID(ctx)
 	if err != nil {
 		rus.Error(err)
-		return &pb.Void{}, err
-	}
-	if err != nil {
-		rus.Error(err)
-		return &pb.Void{}, err
+		return &pb.Void{}, toGRPCError(ctx, err, "")
 	}
 	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
 	ctx = newGRPCTraceContext(ctx, traceID)
@@ -177,7 +274,7 @@ func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
 
 	}()
 
-	idt, err := lib.ParseToken(req.AccessToken, s.p.sharedSecret)
+	idt, _, err := s.authenticate(ctx, &req.AccessToken)
 	if err != nil {
 		log.Error(err)
 		return &pb.Void{}, unauthenticatedError
@@ -185,38 +282,114 @@ func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
 
 	log.Infof("%s", idt)
 
-	src := path.Clean(req.Src)
-	dst := path.Clean(req.Dst)
+	// reads of the caller go to the primary for a while
+	defer s.replicas.wrote(idt.Pid)
+
+	release, err := s.limit(ctx, "mv", idt)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+	defer release()
+
+	ctx, cancel := s.withTimeout(ctx, "mv")
+	defer cancel()
+
+	src, err := s.paths.canonical(req.Src)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(ctx, err, "")
+	}
+
+	dst, err := s.paths.canonical(req.Dst)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(ctx, err, "")
+	}
 
 	log.Infof("src path is %s", src)
 	log.Infof("dst path is %s", dst)
 
-	recs, err := s.getRecordsWithPathPrefix(src)
+	src, err = s.resolvePath(ctx, src)
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, nil
+		return &pb.Void{}, toGRPCError(ctx, err, req.Src)
+	}
+
+	// in a case insensitive namespace dst may name src in another case
+	if isAncestor(s.pathKey(src), s.pathKey(dst)) {
+		log.Errorf("cannot move %s into its own subtree %s", src, dst)
+		return &pb.Void{}, newGRPCError(ctx, codes.InvalidArgument, reasonInvalidPath, dst,
+			"cannot move a directory into its own subtree")
 	}
 
-	tx := s.db.Begin()
-	for _, rec := range recs {
-		newPath := path.Join(dst, path.Clean(strings.TrimPrefix(rec.Path, src)))
-		log.Infof("src path %s will be renamed to %s", rec.Path, newPath)
+	collision, err := s.mvCaseCollision(ctx, src, dst)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(ctx, err, dst)
+	}
+	if collision != nil {
+		log.Errorf("dst path %s collides with %s", dst, collision.Path)
+		return &pb.Void{}, newGRPCError(ctx, codes.AlreadyExists, reasonCaseCollision, collision.Path,
+			"path collides with an existing path that only differs in case")
+	}
 
-		err = s.db.Model(record{}).Where("id=?", rec.ID).Updates(record{Path: newPath}).Error
+	if s.tree {
+		err = s.treeMove(ctx, src, dst)
+		s.records.purge()
 		if err != nil {
 			log.Error(err)
-			tx.Rollback()
-			return &pb.Void{}, err
+			return &pb.Void{}, toGRPCError(ctx, err, src)
+		}
+		log.Infof("moved node of %s to %s", src, dst)
+	} else {
+		recs, err := s.getRecordsWithPathPrefix(ctx, src)
+		if err != nil {
+			log.Error(err)
+			return &pb.Void{}, toGRPCError(ctx, err, src)
 		}
-	}
-	tx.Commit()
 
-	log.Infof("renamed %d entries", len(recs))
+		if len(recs) == 0 {
+			return &pb.Void{}, toGRPCError(ctx, gorm.RecordNotFound, src)
+		}
+
+		tx, err := s.db.DB().BeginTx(ctx, nil)
+		if err != nil {
+			log.Error(err)
+			return &pb.Void{}, toGRPCError(ctx, err, src)
+		}
+		for _, rec := range recs {
+			newPath := path.Join(dst, path.Clean(strings.TrimPrefix(rec.Path, src)))
+			log.Infof("src path %s will be renamed to %s", rec.Path, newPath)
+
+			// descendants may exceed the limits once moved under dst
+			if _, err := canonicalPath(newPath); err != nil {
+				log.Error(err)
+				tx.Rollback()
+				return &pb.Void{}, toGRPCError(ctx, err, "")
+			}
+
+			_, err = tx.ExecContext(ctx, "UPDATE records SET path=?, fold_path=? WHERE id=?", newPath, s.paths.fold(newPath), rec.ID)
+			if err != nil {
+				log.Error(err)
+				tx.Rollback()
+				return &pb.Void{}, toGRPCError(ctx, err, newPath)
+			}
+		}
+		err = tx.Commit()
+		s.records.purge()
+		if err != nil {
+			log.Error(err)
+			return &pb.Void{}, toGRPCError(ctx, err, dst)
+		}
+
+		log.Infof("renamed %d entries", len(recs))
+	}
 
 	etag, err := uuid.NewV4()
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, err
+		return &pb.Void{}, toGRPCError(ctx, err, dst)
 	}
 	mtime := uint32(time.Now().Unix())
 	err = s.propagateChanges(ctx, dst, etag.String(), mtime, "")
@@ -229,15 +402,41 @@ func (s *server) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
 	return &pb.Void{}, nil
 }
 
-func (s *server) getRecordsWithPathPrefix(p string) ([]record, error) {
+// mvCaseCollision returns a record outside the src subtree that would
+// only differ in case from dst, its ancestors or the moved descendants.
+func (s *server) mvCaseCollision(ctx context.Context, src, dst string) (*record, error) {
+
+	collision, err := s.caseCollision(ctx, dst, src)
+	if err != nil || collision != nil {
+		return collision, err
+	}
+
+	// moved nodes keep their names under dst, only dst can collide
+	if !s.paths.caseInsensitive || s.tree {
+		return nil, nil
+	}
+
+	recs, err := queryRecords(ctx, s.db.DB(), "fold_path LIKE ? ESCAPE '"+likeEscape+"'", likePrefix(s.paths.fold(dst)+"/"))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range recs {
+		if recs[i].Path != src && !isAncestor(src, recs[i].Path) {
+			return &recs[i], nil
+		}
+	}
+
+	return nil, nil
+}
 
-	var recs []record
+func (s *server) getRecordsWithPathPrefix(ctx context.Context, p string) ([]record, error) {
 
-	// the regexp is path/% instead of path% to avoid getting
+	// the pattern is path/% instead of path% to avoid getting
 	// path1 and path11 in from the DB
-	err := s.db.Where("path LIKE ? OR path=?", p+"/%", p).Find(&recs).Error
+	recs, err := queryRecords(ctx, s.db.DB(), "path LIKE ? ESCAPE '"+likeEscape+"' OR path=?", likePrefix(p+"/"), p)
 	if err != nil {
-		return recs, nil
+		return recs, err
 	}
 
 	return recs, nil
@@ -247,7 +446,7 @@ func (s *server) Rm(ctx context.Context, req *pb.RmReq) (*pb.Void, error) {
 	traceID, err := getGRPCTraceID(ctx)
 	if err != nil {
 		rus.Error(err)
-		return &pb.Void{}, err
+		return &pb.Void{}, toGRPCError(ctx, err, "")
 	}
 	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
 	ctx = newGRPCTraceContext(ctx, traceID)
@@ -270,7 +469,7 @@ func (s *server) Rm(ctx context.Context, req *pb.RmReq) (*pb.Void, error) {
 
 	}()
 
-	idt, err := lib.ParseToken(req.AccessToken, s.p.sharedSecret)
+	idt, _, err := s.authenticate(ctx, &req.AccessToken)
 	if err != nil {
 		log.Error(err)
 		return &pb.Void{}, unauthenticatedError
@@ -278,20 +477,56 @@ func (s *server) Rm(ctx context.Context, req *pb.RmReq) (*pb.Void, error) {
 
 	log.Infof("%s", idt)
 
-	p := path.Clean(req.Path)
+	// reads of the caller go to the primary for a while
+	defer s.replicas.wrote(idt.Pid)
+
+	release, err := s.limit(ctx, "rm", idt)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+	defer release()
+
+	ctx, cancel := s.withTimeout(ctx, "rm")
+	defer cancel()
+
+	p, err := s.paths.canonical(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(ctx, err, "")
+	}
+
+	// the homes are not removed with all they hold, nor what is above
+	if p == "/" || strings.Count(p, "/") <= s.getRuntime().homeDepth {
+		err = newGRPCError(ctx, codes.InvalidArgument, reasonInvalidPath, req.Path, "cannot remove %s, only what is under a home directory", p)
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+
+	p, err = s.resolvePath(ctx, p)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(ctx, err, req.Path)
+	}
 
 	log.Infof("path is %s", p)
 
 	ts := time.Now().Unix()
-	err = s.db.Where("(path LIKE ? OR path=? ) AND m_time < ?", p+"/%", p, ts).Delete(record{}).Error
+	if s.tree {
+		err = s.treeRemove(ctx, p, ts)
+	} else {
+		_, err = s.db.DB().ExecContext(ctx, "DELETE FROM records WHERE (path LIKE ? ESCAPE '"+likeEscape+"' OR path=?) AND m_time < ?", likePrefix(p+"/"), p, ts)
+	}
+	s.records.purge()
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, err
+		return &pb.Void{}, toGRPCError(ctx, err, p)
 	}
 
 	etag, err := uuid.NewV4()
 	if err != nil {
-		return &pb.Void{}, err
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(ctx, err, p)
 	}
 
 	err = s.propagateChanges(ctx, p, etag.String(), uint32(ts), "")
@@ -309,7 +544,7 @@ func (s *server) Put(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
 	traceID, err := getGRPCTraceID(ctx)
 	if err != nil {
 		rus.Error(err)
-		return &pb.Void{}, err
+		return &pb.Void{}, toGRPCError(ctx, err, "")
 	}
 	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
 	ctx = newGRPCTraceContext(ctx, traceID)
@@ -332,7 +567,7 @@ func (s *server) Put(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
 
 	}()
 
-	idt, err := lib.ParseToken(req.AccessToken, s.p.sharedSecret)
+	idt, _, err := s.authenticate(ctx, &req.AccessToken)
 	if err != nil {
 		log.Error(err)
 		return &pb.Void{}, unauthenticatedError
@@ -340,44 +575,98 @@ func (s *server) Put(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
 
 	log.Infof("%s", idt)
 
-	p := path.Clean(req.Path)
+	// reads of the caller go to the primary for a while
+	defer s.replicas.wrote(idt.Pid)
+
+	release, err := s.limit(ctx, "put", idt)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, err
+	}
+	defer release()
+
+	ctx, cancel := s.withTimeout(ctx, "put")
+	defer cancel()
+
+	p, err := s.paths.canonical(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.Void{}, toGRPCError(ctx, err, "")
+	}
 
 	log.Infof("path is %s", p)
 
+	err = s.put(ctx, p, req.Checksum)
+	if err != nil {
+		return &pb.Void{}, toGRPCError(ctx, err, p)
+	}
+
+	return &pb.Void{}, nil
+}
+
+// put creates or updates the record of p and propagates the change
+// to its ancestors. It is shared by Put and by Get with ForceCreation,
+// which must not be limited twice.
+func (s *server) put(ctx context.Context, p, checksum string) error {
+
+	traceID, err := getGRPCTraceID(ctx)
+	if err != nil {
+		rus.Error(err)
+		return err
+	}
+	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
+
 	var id string
 	rawEtag, err := uuid.NewV4()
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, err
+		return err
 	}
 	etag := rawEtag.String()
 
 	var mtime = uint32(time.Now().Unix())
 
-	r, err := s.getByPath(p)
+	collision, err := s.caseCollision(ctx, p, "")
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if collision != nil {
+		log.Errorf("path %s collides with %s", p, collision.Path)
+		return newGRPCError(ctx, codes.AlreadyExists, reasonCaseCollision, collision.Path,
+			"path collides with an existing path that only differs in case")
+	}
+
+	r, err := s.getByPath(ctx, p)
 	if err != nil {
 		log.Error(err)
 		if err == gorm.RecordNotFound {
 			rawEtag, err := uuid.NewV4()
 			if err != nil {
 				log.Error(err)
-				return &pb.Void{}, err
+				return err
 			}
 
 			id = rawEtag.String()
 		} else {
-			return &pb.Void{}, err
+			return err
 		}
 	} else {
 		id = r.ID
 	}
 
-	log.Infof("new record will have id=%s path=%s checksum=%s etag=%s mtime=%d", id, p, req.Checksum, etag, mtime)
+	log.Infof("new record will have id=%s path=%s checksum=%s etag=%s mtime=%d", id, p, checksum, etag, mtime)
 
-	err = s.insert(id, p, req.Checksum, etag, mtime)
+	if s.tree {
+		err = s.treePut(ctx, id, p, checksum, etag, mtime)
+	} else {
+		err = s.insert(ctx, id, p, s.paths.fold(p), checksum, etag, mtime)
+	}
+	// a failed statement may still have changed the record
+	s.records.invalidate(s.pathKey(p))
 	if err != nil {
 		log.Error(err)
-		return &pb.Void{}, err
+		return err
 	}
 
 	log.Infof("new record saved to db")
@@ -389,21 +678,249 @@ func (s *server) Put(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
 
 	log.Infof("propagated changes till ancestor %s", "")
 
-	return &pb.Void{}, nil
+	return nil
 }
 
-func (s *server) getByPath(path string) (*record, error) {
+func (s *server) List(ctx context.Context, req *pb.ListReq) (*pb.Records, error) {
+
+	traceID, err := getGRPCTraceID(ctx)
+	if err != nil {
+		rus.Error(err)
+		return &pb.Records{}, toGRPCError(ctx, err, "")
+	}
+	log := rus.WithField("trace", traceID).WithField("svc", serviceID)
+	ctx = newGRPCTraceContext(ctx, traceID)
+
+	log.Info("request started")
+
+	// Time request
+	reqStart := time.Now()
+
+	defer func() {
+		// Compute request duration
+		reqDur := time.Since(reqStart)
 
-	r := &record{}
-	err := s.db.Where("path=?", path).First(r).Error
-	return r, err
+		// Log access info
+		log.WithFields(rus.Fields{
+			"method":   "list",
+			"type":     "grpcaccess",
+			"duration": reqDur.Seconds(),
+		}).Info("request finished")
+
+	}()
+
+	idt, _, err := s.authenticate(ctx, &req.AccessToken)
+	if err != nil {
+		log.Error(err)
+		return &pb.Records{}, unauthenticatedError
+	}
+
+	log.Infof("%s", idt)
+
+	release, err := s.limit(ctx, "list", idt)
+	if err != nil {
+		log.Error(err)
+		return &pb.Records{}, err
+	}
+	defer release()
+
+	ctx, cancel := s.withTimeout(ctx, "list")
+	defer cancel()
+
+	p, err := s.paths.canonical(req.Path)
+	if err != nil {
+		log.Error(err)
+		return &pb.Records{}, toGRPCError(ctx, err, "")
+	}
+
+	readCtx := s.withReplica(ctx, idt.Pid)
+	resolved, recs, err := s.list(readCtx, p, req.Recursive)
+	if replicaFailed(readCtx, err) {
+		resolved, recs, err = s.list(ctx, p, req.Recursive)
+	}
+	if err != nil {
+		log.Error(err)
+		return &pb.Records{}, toGRPCError(ctx, err, req.Path)
+	}
+	p = resolved
+
+	log.Infof("path is %s", p)
+
+	res := &pb.Records{}
+	for i := range recs {
+		// direct children have no slash after the parent path
+		rel := strings.TrimPrefix(recs[i].Path, strings.TrimSuffix(p, "/")+"/")
+		if !req.Recursive && strings.Contains(rel, "/") {
+			continue
+		}
+		res.Records = append(res.Records, newPBRecord(&recs[i]))
+	}
+
+	log.Infof("listed %d records", len(res.Records))
+
+	return res, nil
+}
+
+// getDescendants returns the records under p ordered by path.
+func (s *server) getDescendants(ctx context.Context, p string) ([]record, error) {
+	if s.tree {
+		return s.treeGetDescendants(ctx, p, false)
+	}
+	recs := []record{}
+	err := s.eachDescendant(ctx, p, func(r *record) error {
+		recs = append(recs, *r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// eachDescendant calls f with every record under p as it is read,
+// parents before their children: ordered by path in the path layout
+// and level by level in the tree layout.
+func (s *server) eachDescendant(ctx context.Context, p string, f func(r *record) error) error {
+	if s.tree {
+		return s.treeEachDescendant(ctx, p, f)
+	}
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	if s.paths.caseInsensitive {
+		return eachRecord(ctx, s.readDB(ctx), "fold_path LIKE ? ESCAPE '"+likeEscape+"' ORDER BY path", f, likePrefix(s.paths.fold(prefix)))
+	}
+	return eachRecord(ctx, s.readDB(ctx), "path LIKE ? ESCAPE '"+likeEscape+"' ORDER BY path", f, likePrefix(prefix))
+}
+
+// list returns the path p is stored under with the records under it,
+// only the direct children unless recursive.
+func (s *server) list(ctx context.Context, p string, recursive bool) (string, []record, error) {
+	p, err := s.resolvePath(ctx, p)
+	if err != nil {
+		return "", nil, err
+	}
+	getRecords := s.getChildren
+	if recursive {
+		getRecords = s.getDescendants
+	}
+	recs, err := getRecords(ctx, p)
+	return p, recs, err
+}
+
+// getChildren returns the records directly under p ordered by path.
+// In a case insensitive namespace the descendants are filtered instead,
+// as the parent path is stored in the case of each record.
+func (s *server) getChildren(ctx context.Context, p string) ([]record, error) {
+	if s.tree {
+		return s.treeGetDescendants(ctx, p, true)
+	}
+	if s.paths.caseInsensitive {
+		return s.getDescendants(ctx, p)
+	}
+	return queryRecords(ctx, s.readDB(ctx), "parent_path=? ORDER BY path", p)
+}
+
+// getByPath returns the record stored under path. In a case insensitive
+// namespace the path of the returned record may differ in case.
+func (s *server) getByPath(ctx context.Context, path string) (*record, error) {
+
+	if s.tree {
+		return s.treeGetByPath(ctx, path)
+	}
+
+	if s.paths.caseInsensitive {
+		return queryRecord(ctx, s.readDB(ctx), "fold_path=?", s.paths.fold(path))
+	}
+	return queryRecord(ctx, s.readDB(ctx), "path=?", path)
+}
+
+// resolvePath returns the path p is stored under, which in a case
+// insensitive namespace can differ in case from p.
+// If there is no record for p, p is returned.
+func (s *server) resolvePath(ctx context.Context, p string) (string, error) {
+
+	if !s.paths.caseInsensitive {
+		return p, nil
+	}
+
+	r, err := s.getByPath(ctx, p)
+	if err == gorm.RecordNotFound {
+		return p, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return r.Path, nil
 }
 
-func (s *server) insert(id, p, checksum, etag string, mtime uint32) error {
+// caseCollision returns a record whose path only differs in case from p
+// or from one of its ancestors, ignoring the records under the ignore
+// subtree. It returns nil if the namespace is case sensitive.
+func (s *server) caseCollision(ctx context.Context, p, ignore string) (*record, error) {
 
-	err := s.db.Exec(`INSERT INTO records (id,path,checksum, e_tag, m_time) VALUES (?,?,?,?,?)
+	if !s.paths.caseInsensitive {
+		return nil, nil
+	}
+
+	if s.tree {
+		return s.treeCaseCollision(ctx, p, ignore)
+	}
+
+	wanted := map[string]string{}
+	folds := []interface{}{}
+	for _, a := range pathAndAncestors(p) {
+		f := s.paths.fold(a)
+		wanted[f] = a
+		folds = append(folds, f)
+	}
+
+	recs, err := queryRecords(ctx, s.db.DB(), "fold_path IN ("+placeholders(len(folds))+")", folds...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range recs {
+		if ignore != "" && (recs[i].Path == ignore || isAncestor(ignore, recs[i].Path)) {
+			continue
+		}
+		if recs[i].Path != wanted[recs[i].FoldPath] {
+			return &recs[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// backfillFoldPaths computes the folded path of the records
+// created before the fold_path column existed.
+func (s *server) backfillFoldPaths() error {
+
+	ctx := context.Background()
+	for {
+		recs, err := queryRecords(ctx, s.db.DB(), "fold_path IS NULL OR fold_path='' LIMIT 1000")
+		if err != nil {
+			return err
+		}
+
+		if len(recs) == 0 {
+			return nil
+		}
+
+		for _, rec := range recs {
+			_, err = s.db.DB().ExecContext(ctx, "UPDATE records SET fold_path=? WHERE id=?", s.paths.fold(rec.Path), rec.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		rus.Infof("backfilled folded path of %d records", len(recs))
+	}
+}
+
+func (s *server) insert(ctx context.Context, id, p, foldPath, checksum, etag string, mtime uint32) error {
+
+	_, err := s.db.DB().ExecContext(ctx, `INSERT INTO records (id,path,fold_path,checksum, e_tag, m_time) VALUES (?,?,?,?,?,?)
 	ON DUPLICATE KEY UPDATE checksum=VALUES(checksum), e_tag=VALUES(e_tag), m_time=VALUES(m_time)`,
-		id, p, checksum, etag, mtime).Error
+		id, p, foldPath, checksum, etag, mtime)
 
 	if err != nil {
 		return err
@@ -411,17 +928,25 @@ func (s *server) insert(id, p, checksum, etag string, mtime uint32) error {
 
 	return nil
 }
-func (s *server) update(p, etag string, mtime uint32) int64 {
+func (s *server) update(ctx context.Context, p, etag string, mtime uint32) (int64, error) {
+
+	if s.tree {
+		return s.treeUpdate(ctx, p, etag, mtime)
+	}
 
-	return s.db.Model(record{}).Where("path=? AND m_time < ?", p, mtime).Updates(record{ETag: etag, MTime: mtime}).RowsAffected
+	res, err := s.db.DB().ExecContext(ctx, "UPDATE records SET e_tag=?, m_time=? WHERE path=? AND m_time < ?", etag, mtime, p, mtime)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
 // propagateChanges propagates mtime and etag until the user home directory
 // This propagation is needed for the client to discover changes
 // Ex: given the successful upload of the file /local/users/d/demo/photos/1.png
 // the etag and mtime will be propagated to:
-//    - /local/users/d/demo/photos
-//    - /local/users/d/demo
+//   - /local/users/d/demo/photos
+//   - /local/users/d/demo
 func (s *server) propagateChanges(ctx context.Context, p, etag string, mtime uint32, stopPath string) error {
 
 	traceID, err := getGRPCTraceID(ctx)
@@ -434,9 +959,13 @@ func (s *server) propagateChanges(ctx context.Context, p, etag string, mtime uin
 
 	// TODO(labkode) assert the list ordered from most deeper to less so we can shortcircuit
 	// after first miss
-	paths := getPathsTillHome(ctx, p)
+	paths := getPathsTillHome(ctx, p, s.getRuntime().homeDepth)
 	for _, p := range paths {
-		numRows := s.update(p, etag, mtime)
+		numRows, err := s.update(ctx, p, etag, mtime)
+		s.records.invalidate(s.pathKey(p))
+		if err != nil {
+			return err
+		}
 		if numRows == 0 {
 			log.Warnf("parent path %s has been updated in the meanwhile so we do not override with old info. Propagation stopped", p)
 			// Following the CAS tree approach it does not make sense to update\
@@ -449,7 +978,9 @@ func (s *server) propagateChanges(ctx context.Context, p, etag string, mtime uin
 	return nil
 }
 
-func getPathsTillHome(ctx context.Context, p string) []string {
+// getPathsTillHome returns the ancestors of p up to its home directory,
+// the first homeDepth elements of p, deepest first.
+func getPathsTillHome(ctx context.Context, p string, homeDepth int) []string {
 
 	traceID, err := getGRPCTraceID(ctx)
 	if err != nil {
@@ -463,13 +994,14 @@ func getPathsTillHome(ctx context.Context, p string) []string {
 	paths := []string{}
 	tokens := strings.Split(p, "/")
 
-	if len(tokens) < 5 {
+	// tokens[0] is the empty element before the leading slash
+	if len(tokens) < homeDepth+1 {
 		// if not under home dir we do not propagate
 		return paths
 	}
 
-	homeTokens := tokens[0:5]
-	restTokens := tokens[5:]
+	homeTokens := tokens[0 : homeDepth+1]
+	restTokens := tokens[homeDepth+1:]
 
 	home := path.Clean("/" + path.Join(homeTokens...))
 
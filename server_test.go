@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDSNEnvar names the MySQL database the tests needing one run
+// against. Its records and nodes are deleted by every such test.
+const testDSNEnvar = "CLAWIO_LOCALFS_PROP_TEST_DSN"
+
+// testReplicaDSNEnvar names a second database the replica tests use as
+// a replica that never catches up with the primary.
+const testReplicaDSNEnvar = "CLAWIO_LOCALFS_PROP_TEST_REPLICA_DSN"
+
+const testSharedSecret = "test-secret"
+
+// testDSN returns the DSN of the test database or skips tb.
+func testDSN(tb testing.TB) string {
+	dsn := os.Getenv(testDSNEnvar)
+	if dsn == "" {
+		tb.Skipf("%s not set", testDSNEnvar)
+	}
+	return dsn
+}
+
+// newTestServer returns a server with the default configuration,
+// changed by opts, and layout on an empty test database.
+func newTestServer(tb testing.TB, layout string, opts ...func(c *config)) *server {
+	c := defaultConfig()
+	c.DSN = testDSN(tb)
+	c.SharedSecret = testSharedSecret
+	c.MaxSQLIdle = 4
+	c.MaxSQLConcurrency = 16
+	c.Layout = layout
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	s, err := newServer(newServerParamsFromConfig(c))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"DELETE FROM records",
+		"DELETE FROM nodes",
+		"UPDATE tree_generation SET generation=generation+1 WHERE id=1",
+	} {
+		if _, err := s.db.DB().Exec(stmt); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return s
+}
+
+// testToken returns an access token of the test user
+// signed with the shared secret.
+func testToken(tb testing.TB) string {
+	t := jwt.New(jwt.SigningMethodHS256)
+	t.Claims["pid"] = "test"
+	t.Claims["idp"] = "localhost"
+	t.Claims["display_name"] = "Test"
+	t.Claims["email"] = "test@localhost"
+	t.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	token, err := t.SignedString([]byte(testSharedSecret))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return token
+}
+
+// TestLongPaths stores, reads, lists and moves a record
+// of a path of the maximum length in both layouts.
+func TestLongPaths(t *testing.T) {
+	for _, layout := range []string{layoutPath, layoutTree} {
+		t.Run(layout, func(t *testing.T) {
+			s := newTestServer(t, layout)
+			ctx := context.Background()
+			token := testToken(t)
+
+			p := longPath(repeatSize(16, 255)...)
+			dst := path.Join(path.Dir(p), strings.Repeat("z", 255))
+			if len(p) != maxPathLength || len(dst) != maxPathLength {
+				t.Fatalf("paths of %d and %d bytes, want %d", len(p), len(dst), maxPathLength)
+			}
+
+			if _, err := s.Put(ctx, &pb.PutReq{AccessToken: token, Path: p, Checksum: "md5:1"}); err != nil {
+				t.Fatal(err)
+			}
+
+			rec, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: p})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Path != p || rec.Checksum != "md5:1" {
+				t.Fatalf("got record of %d bytes with checksum %q", len(rec.Path), rec.Checksum)
+			}
+
+			recs, err := s.List(ctx, &pb.ListReq{AccessToken: token, Path: path.Dir(p)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recs.Records) != 1 || recs.Records[0].Path != p {
+				t.Fatalf("listed %d records, want the one put", len(recs.Records))
+			}
+
+			if _, err := s.Mv(ctx, &pb.MvReq{AccessToken: token, Src: p, Dst: dst}); err != nil {
+				t.Fatal(err)
+			}
+			if rec, err = s.Get(ctx, &pb.GetReq{AccessToken: token, Path: dst}); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Path != dst || rec.Id == "" {
+				t.Fatalf("moved record has a path of %d bytes", len(rec.Path))
+			}
+			if _, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: p}); grpc.Code(err) != codes.NotFound {
+				t.Fatalf("get of the moved path: %v, want not found", err)
+			}
+		})
+	}
+}
+
+// TestMvLimitsOfDescendants moves a directory under a path where a
+// descendant would exceed the path length in both layouts.
+func TestMvLimitsOfDescendants(t *testing.T) {
+	for _, layout := range []string{layoutPath, layoutTree} {
+		t.Run(layout, func(t *testing.T) {
+			s := newTestServer(t, layout)
+			ctx := context.Background()
+			token := testToken(t)
+
+			// src/f fits, but not once src is renamed to a longer name
+			src := longPath(repeatSize(15, 255)...) + "/d"
+			dst := path.Join(path.Dir(src), strings.Repeat("d", 200))
+			f := src + "/" + strings.Repeat("f", 200)
+			if _, err := s.Put(ctx, &pb.PutReq{AccessToken: token, Path: f}); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := s.Mv(ctx, &pb.MvReq{AccessToken: token, Src: src, Dst: dst})
+			if grpc.Code(err) != codes.InvalidArgument {
+				t.Fatalf("mv: %v, want invalid argument", err)
+			}
+			if _, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: f}); err != nil {
+				t.Fatalf("get of the descendant after the failed mv: %v", err)
+			}
+		})
+	}
+}
+
+// TestTreeSiblingsDifferingInCase puts siblings only differing in
+// case in a case sensitive namespace with the tree layout.
+func TestTreeSiblingsDifferingInCase(t *testing.T) {
+	s := newTestServer(t, layoutTree)
+	ctx := context.Background()
+	token := testToken(t)
+
+	for _, p := range []string{"/local/users/d/demo/A", "/local/users/d/demo/a"} {
+		if _, err := s.Put(ctx, &pb.PutReq{AccessToken: token, Path: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs, err := s.List(ctx, &pb.ListReq{AccessToken: token, Path: "/local/users/d/demo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs.Records) != 2 {
+		t.Fatalf("listed %d records, want 2", len(recs.Records))
+	}
+}
+
+// TestMvIntoOwnSubtreeInOtherCase moves a directory under itself named
+// in another case in a case insensitive namespace, which would make
+// its node its own ancestor with the tree layout.
+func TestMvIntoOwnSubtreeInOtherCase(t *testing.T) {
+	for _, layout := range []string{layoutPath, layoutTree} {
+		t.Run(layout, func(t *testing.T) {
+			s := newTestServer(t, layout, func(c *config) { c.CaseInsensitive = true })
+			ctx := context.Background()
+			token := testToken(t)
+
+			src := "/local/users/d/demo/a/b"
+			if _, err := s.Put(ctx, &pb.PutReq{AccessToken: token, Path: src + "/f"}); err != nil {
+				t.Fatal(err)
+			}
+			_, err := s.Mv(ctx, &pb.MvReq{AccessToken: token, Src: src, Dst: "/local/users/d/demo/a/B/c"})
+			if grpc.Code(err) != codes.InvalidArgument {
+				t.Fatalf("mv: %v, want invalid argument", err)
+			}
+			if _, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: src + "/f"}); err != nil {
+				t.Fatalf("get after the failed mv: %v", err)
+			}
+		})
+	}
+}
+
+// TestRmRootAndHomes removes the root and a home directory, which is
+// refused in both layouts.
+func TestRmRootAndHomes(t *testing.T) {
+	for _, layout := range []string{layoutPath, layoutTree} {
+		t.Run(layout, func(t *testing.T) {
+			s := newTestServer(t, layout)
+			ctx := context.Background()
+			token := testToken(t)
+
+			f := "/local/users/d/demo/f"
+			if _, err := s.Put(ctx, &pb.PutReq{AccessToken: token, Path: f}); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{"/", "/local", "/local/users/d/demo"} {
+				if _, err := s.Rm(ctx, &pb.RmReq{AccessToken: token, Path: p}); grpc.Code(err) != codes.InvalidArgument {
+					t.Errorf("rm %s: %v, want invalid argument", p, err)
+				}
+			}
+			if _, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: f}); err != nil {
+				t.Fatalf("get after the refused removals: %v", err)
+			}
+		})
+	}
+}
+
+// TestTreeRmKeepsNewerNodes removes a directory in which a node was
+// put after the removal started, as a concurrent Put would.
+func TestTreeRmKeepsNewerNodes(t *testing.T) {
+	s := newTestServer(t, layoutTree)
+	ctx := context.Background()
+	token := testToken(t)
+
+	dir := "/local/users/d/demo/dir"
+	for _, p := range []string{dir + "/old", dir + "/sub/new"} {
+		if _, err := s.Put(ctx, &pb.PutReq{AccessToken: token, Path: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := time.Now().Unix()
+	if _, err := s.db.DB().Exec("UPDATE nodes SET m_time=? WHERE name='new'", ts+60); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.treeRemove(ctx, dir, ts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: dir + "/old"}); grpc.Code(err) != codes.NotFound {
+		t.Errorf("get of the older node: %v, want not found", err)
+	}
+	rec, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: dir + "/sub/new"})
+	if err != nil {
+		t.Fatalf("get of the newer node: %v", err)
+	}
+	if rec.Modified != uint32(ts+60) {
+		t.Errorf("newer node modified at %d, want %d", rec.Modified, ts+60)
+	}
+}
+
+// TestLayoutMaintenance exports, imports, checks and reconciles
+// records in both layouts.
+func TestLayoutMaintenance(t *testing.T) {
+	for _, layout := range []string{layoutPath, layoutTree} {
+		t.Run(layout, func(t *testing.T) {
+			s := newTestServer(t, layout)
+			ctx := context.Background()
+			token := testToken(t)
+
+			home := "/local/users/d/demo"
+			for _, p := range []string{home, home + "/photos", home + "/photos/1.png", home + "/docs/a.txt"} {
+				if _, err := s.Put(ctx, &pb.PutReq{AccessToken: token, Path: p}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			buf := &bytes.Buffer{}
+			exported, err := s.exportRecords(ctx, home, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst := "/local/users/c/copy"
+			imported, err := s.importRecords(ctx, buf, &importOptions{root: dst})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imported != exported || exported != 4 {
+				t.Fatalf("exported %d records and imported %d, want 4", exported, imported)
+			}
+			rec, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: dst + "/photos/1.png"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Path != dst+"/photos/1.png" {
+				t.Fatalf("imported record at %s", rec.Path)
+			}
+
+			// home/docs has no record, a violation in the path layout only
+			report, err := s.fsck(ctx, home, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.homes != 1 || len(report.staleMTime) != 0 || len(report.orphaned) != map[string]int{layoutPath: 1, layoutTree: 0}[layout] {
+				t.Fatalf("fsck found %d homes, %d stale mtimes and %d orphans", report.homes, len(report.staleMTime), len(report.orphaned))
+			}
+
+			dir, err := ioutil.TempDir("", "reconcile")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for _, name := range []string{"photos/1.png", "photos/2.png"} {
+				name = filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(name, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := s.reconcile(ctx, &reconcileOptions{root: dir, prefix: home}); err != nil {
+				t.Fatal(err)
+			}
+			recs, err := s.List(ctx, &pb.ListReq{AccessToken: token, Path: home, Recursive: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, r := range recs.Records {
+				got = append(got, r.Path)
+			}
+			want := []string{home + "/photos", home + "/photos/1.png", home + "/photos/2.png"}
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Fatalf("records after reconcile %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestGetForceCreationWithLaggingReplica gets with ForceCreation a
+// record the replica does not have yet.
+func TestGetForceCreationWithLaggingReplica(t *testing.T) {
+	testDSN(t)
+	replicaDSN := os.Getenv(testReplicaDSNEnvar)
+	if replicaDSN == "" {
+		t.Skipf("%s not set", testReplicaDSNEnvar)
+	}
+	replica, err := newDB("mysql", replicaDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	if err := migrateUp(context.Background(), replica.DB(), latestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replica.DB().Exec("DELETE FROM records"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t, layoutPath, func(c *config) {
+		c.ReplicaDSNs = []string{replicaDSN}
+		// every read goes to the replica
+		c.ReadYourWritesWindow = 0
+	})
+	ctx := context.Background()
+	token := testToken(t)
+
+	p := "/local/users/d/demo/1.png"
+	if _, err := s.Put(ctx, &pb.PutReq{AccessToken: token, Path: p, Checksum: "md5:1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: p}); grpc.Code(err) != codes.NotFound {
+		t.Fatalf("get from the replica: %v, want not found", err)
+	}
+
+	rec, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: p, ForceCreation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Checksum != "md5:1" {
+		t.Fatalf("checksum = %q, want the one put on the primary", rec.Checksum)
+	}
+}
+
+// TestNormalize stores paths as sent in both layouts and normalizes
+// them to NFC once that form is configured.
+func TestNormalize(t *testing.T) {
+	for _, layout := range []string{layoutPath, layoutTree} {
+		t.Run(layout, func(t *testing.T) {
+			s := newTestServer(t, layout, func(c *config) { c.Normalization = "none" })
+			ctx := context.Background()
+			token := testToken(t)
+
+			home := "/local/users/d/demo"
+			nfd, nfc := home+"/cafe\u0301", home+"/caf\u00e9"
+			// the second one of each pair is lost to the first one
+			for _, p := range []string{home, nfd, home + "/x/e\u0301", home + "/x/\u00e9"} {
+				if _, err := s.Put(ctx, &pb.PutReq{AccessToken: token, Path: p}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			paths, err := newPathPolicy("nfc", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.paths = paths
+
+			if _, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: nfc}); grpc.Code(err) != codes.NotFound {
+				t.Fatalf("get before normalizing: %v, want not found", err)
+			}
+
+			report, err := s.normalize(ctx, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.normalized) != 1 || len(report.collisions) != 1 {
+				t.Fatalf("dry run normalized %v with collisions %v", report.normalized, report.collisions)
+			}
+			if _, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: nfc}); grpc.Code(err) != codes.NotFound {
+				t.Fatalf("get after the dry run: %v, want not found", err)
+			}
+
+			if report, err = s.normalize(ctx, false); err != nil {
+				t.Fatal(err)
+			}
+			if len(report.normalized) != 1 || len(report.collisions) != 1 || report.clean() {
+				t.Fatalf("normalized %v with collisions %v", report.normalized, report.collisions)
+			}
+			rec, err := s.Get(ctx, &pb.GetReq{AccessToken: token, Path: nfc})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Path != nfc {
+				t.Fatalf("got %q, want %q", rec.Path, nfc)
+			}
+		})
+	}
+}
+
+// TestReloadedLockWaitTimeout reloads the timeouts and checks the
+// database sessions wait for row locks as long as the new longest one.
+func TestReloadedLockWaitTimeout(t *testing.T) {
+	s := newTestServer(t, layoutPath)
+	ctx := context.Background()
+
+	// lockWaits returns the timeouts of n sessions of the pool at once
+	lockWaits := func(n int) []int {
+		conns := []*sql.Conn{}
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		seconds := make([]int, n)
+		for i := range seconds {
+			conn, err := s.db.DB().Conn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, conn)
+			if err := conn.QueryRowContext(ctx, "SELECT @@SESSION.innodb_lock_wait_timeout").Scan(&seconds[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return seconds
+	}
+
+	want := lockWaitTimeout(defaultConfig().Timeouts)
+	for _, seconds := range lockWaits(3) {
+		if seconds != want {
+			t.Fatalf("lock wait timeout of %ds, want %ds", seconds, want)
+		}
+	}
+
+	c := defaultConfig()
+	c.MaxSQLIdle = 4
+	c.MaxSQLConcurrency = 16
+	c.Timeouts = map[string]time.Duration{defaultLimitsKey: 7 * time.Second}
+	s.applyConfig(c)
+	// the idle sessions are reused and a new one is opened
+	for _, seconds := range lockWaits(5) {
+		if seconds != 7 {
+			t.Fatalf("lock wait timeout of %ds after the reload, want 7s", seconds)
+		}
+	}
+}
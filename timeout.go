@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"strings"
+	"time"
+)
+
+// defaultTimeout applies to the methods without a configured timeout.
+const defaultTimeout = 30 * time.Second
+
+// lockWaitTimeout returns the innodb_lock_wait_timeout of the database
+// sessions in seconds, the longest of the timeouts. The driver cannot
+// cancel running statements and MAX_EXECUTION_TIME only applies to
+// SELECTs, so it is what bounds the writes waiting for row locks.
+func lockWaitTimeout(timeouts map[string]time.Duration) int {
+	longest := defaultTimeout
+	if d, ok := timeouts[defaultLimitsKey]; ok {
+		longest = d
+	}
+	for _, d := range timeouts {
+		if d > longest {
+			longest = d
+		}
+	}
+	return int((longest + time.Second - 1) / time.Second)
+}
+
+// parseTimeouts parses a comma separated list of method=duration
+// entries, e.g. "get=2s,mv=5m,*=30s". The * entry applies to the
+// methods without their own.
+func parseTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid timeout %q, expected method=duration", entry)
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %s", entry, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q, it must be positive", entry)
+		}
+
+		timeouts[strings.ToLower(strings.TrimSpace(kv[0]))] = d
+	}
+	return timeouts, nil
+}
+
+// unboundedMethods have no server side timeout unless one is set for
+// them, the * one does not apply: they stream whole subtrees, which
+// can take any time.
+var unboundedMethods = map[string]bool{
+	"export": true,
+	"import": true,
+}
+
+// withTimeout bounds ctx by the server side timeout of method.
+// A shorter deadline set by the client is kept.
+func (s *server) withTimeout(ctx context.Context, method string) (context.Context, context.CancelFunc) {
+	timeouts := s.getRuntime().timeouts
+	d, ok := timeouts[method]
+	if !ok && unboundedMethods[method] {
+		return context.WithCancel(ctx)
+	}
+	if !ok {
+		d, ok = timeouts[defaultLimitsKey]
+	}
+	if !ok {
+		d = defaultTimeout
+	}
+	return context.WithTimeout(ctx, d)
+}
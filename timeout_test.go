@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockWaitTimeout(t *testing.T) {
+	tests := []struct {
+		timeouts map[string]time.Duration
+		seconds  int
+	}{
+		{map[string]time.Duration{}, 30},
+		{map[string]time.Duration{"*": 5 * time.Second}, 5},
+		{map[string]time.Duration{"*": 5 * time.Second, "mv": 5 * time.Minute}, 300},
+		{map[string]time.Duration{"get": time.Second}, 30},
+		// rounded up to whole seconds
+		{map[string]time.Duration{"*": 1500 * time.Millisecond}, 2},
+	}
+	for _, tt := range tests {
+		if seconds := lockWaitTimeout(tt.timeouts); seconds != tt.seconds {
+			t.Errorf("lockWaitTimeout(%v) = %d, want %d", tt.timeouts, seconds, tt.seconds)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	rus "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often at most the certificate files are
+// checked for changes. The check happens during TLS handshakes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the server certificate and the client CA bundle
+// and reloads them when the files change on disk, so rotated
+// certificates are picked up without restarting the service.
+type certReloader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	nextProtos []string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+	checked   time.Time
+}
+
+func newCertReloader(certFile, keyFile, caFile string, nextProtos []string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile, nextProtos: nextProtos}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// newTLSConfig returns the TLS configuration of a listener speaking
+// the nextProtos protocols. If caFile is not empty clients must present
+// a certificate signed by one of the CAs in it.
+func newTLSConfig(certFile, keyFile, caFile string, nextProtos []string) (*tls.Config, error) {
+	r, err := newCertReloader(certFile, keyFile, caFile, nextProtos)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{}
+	c.MinVersion = tls.VersionTLS12
+	c.GetConfigForClient = r.getConfigForClient
+	return c, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// latestModTime returns the most recent modification time of the files.
+func latestModTime(files []string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := latestModTime(r.files())
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+// maybeReload reloads the files if they changed since the last load.
+// Errors are logged and the previous certificates kept, as a half
+// written file during a rotation must not break the listener.
+func (r *certReloader) maybeReload() {
+	r.mu.RLock()
+	due := time.Since(r.checked) > certCheckInterval
+	modTime := r.modTime
+	r.mu.RUnlock()
+
+	if !due {
+		return
+	}
+
+	latest, err := latestModTime(r.files())
+	if err == nil && !latest.After(modTime) {
+		r.mu.Lock()
+		r.checked = time.Now()
+		r.mu.Unlock()
+		return
+	}
+
+	if err == nil {
+		err = r.reload()
+	}
+	if err != nil {
+		rus.Errorf("certificates not reloaded: %s", err)
+		r.mu.Lock()
+		r.checked = time.Now()
+		r.mu.Unlock()
+		return
+	}
+
+	rus.Infof("certificates reloaded from %s", r.certFile)
+}
+
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.maybeReload()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c := &tls.Config{}
+	c.MinVersion = tls.VersionTLS12
+	c.Certificates = []tls.Certificate{*r.cert}
+	// the per client config replaces the one negotiated
+	// by grpc/credentials, which is h2 for gRPC.
+	c.NextProtos = r.nextProtos
+	if r.clientCAs != nil {
+		c.ClientCAs = r.clientCAs
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
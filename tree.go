@@ -0,0 +1,741 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/nu7hatch/gouuid"
+	rus "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage layouts of the records.
+//
+// The path layout stores every record with its full path in the
+// records table, so moving a directory rewrites the path of every
+// descendant. The tree layout stores nodes pointing to their parent
+// with only their name in the nodes table, so moving a directory
+// changes a single row. Paths are resolved walking from the top,
+// through a cache of the nodes already resolved.
+const (
+	layoutPath = "path"
+	layoutTree = "tree"
+)
+
+const (
+	// treeCacheSize is the number of resolved paths cached.
+	treeCacheSize = 100000
+
+	// treeBatchSize is the number of parent IDs queried at once
+	// when walking a subtree.
+	treeBatchSize = 500
+)
+
+// node is a row of the nodes table. Placeholders are the nodes
+// created for the ancestors of a record, as every node needs a
+// parent, and are not records themselves.
+type node struct {
+	id          string
+	parentID    string
+	name        string
+	checksum    string
+	etag        string
+	mtime       uint32
+	placeholder bool
+}
+
+const nodeColumns = "id, parent_id, name, checksum, e_tag, m_time, placeholder"
+
+func scanNode(sc scanner, n *node) error {
+	return sc.Scan(&n.id, &n.parentID, &n.name, &n.checksum, &n.etag, &n.mtime, &n.placeholder)
+}
+
+// nodeRecord returns the record of n stored under p.
+func (s *server) nodeRecord(n *node, p string) record {
+	r := record{}
+	r.ID = n.id
+	r.Path = p
+	r.FoldPath = s.paths.fold(p)
+	r.Checksum = n.checksum
+	r.ETag = n.etag
+	r.MTime = n.mtime
+	return r
+}
+
+// treeRef is a resolved path: the ID of its node and the path
+// in the case it is stored in.
+type treeRef struct {
+	id   string
+	path string
+}
+
+// treeCache caches resolved paths. Moves and removals, on any
+// instance, increase the generation stored in the database, which
+// drops the paths cached under the previous one.
+type treeCache struct {
+	mu         sync.Mutex
+	generation uint64
+	refs       *lru
+}
+
+func newTreeCache() *treeCache {
+	c := &treeCache{}
+	c.refs = newLRU(treeCacheSize)
+	return c
+}
+
+// sync drops the cached paths if generation is not the one they
+// were resolved under.
+func (c *treeCache) sync(generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		c.refs.purge()
+		c.generation = generation
+	}
+}
+
+func (c *treeCache) get(key string) (treeRef, bool) {
+	v, ok := c.refs.get(key)
+	if !ok {
+		return treeRef{}, false
+	}
+	return v.(treeRef), true
+}
+
+// add caches ref if generation is still the current one.
+func (c *treeCache) add(generation uint64, key string, ref treeRef) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.refs.add(key, ref, time.Time{})
+	}
+}
+
+// treeGeneration returns the current generation of the tree and
+// syncs the cache with it.
+func (s *server) treeGeneration(ctx context.Context) (uint64, error) {
+	var generation uint64
+	err := s.db.DB().QueryRowContext(ctx, "SELECT generation FROM tree_generation WHERE id=1").Scan(&generation)
+	if err != nil {
+		return 0, err
+	}
+	s.treeCache.sync(generation)
+	return generation, nil
+}
+
+// bumpTreeGeneration increases the generation of the tree in tx,
+// to be called by every statement moving or removing nodes.
+func bumpTreeGeneration(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "UPDATE tree_generation SET generation=generation+1 WHERE id=1")
+	return err
+}
+
+// treeKeyNames rewrites the fold_name of every node, the name siblings
+// are unique by, if the namespace changed its case sensitivity since
+// the nodes were stored. It fails if siblings only differ in case when
+// switching to a case insensitive namespace.
+func (s *server) treeKeyNames(ctx context.Context) error {
+
+	var stored bool
+	err := s.db.DB().QueryRowContext(ctx, "SELECT case_insensitive FROM tree_generation WHERE id=1").Scan(&stored)
+	if err != nil {
+		return err
+	}
+	if stored == s.paths.caseInsensitive {
+		return nil
+	}
+
+	tx, err := s.db.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the keys are set to the unique ids first so the
+	// new ones cannot collide with the old ones
+	if _, err := tx.ExecContext(ctx, "UPDATE nodes SET fold_name=id"); err != nil {
+		return err
+	}
+
+	n := 0
+	last := ""
+	for {
+		rows, err := tx.QueryContext(ctx, "SELECT id, name FROM nodes WHERE id > ? ORDER BY id LIMIT ?", last, treeBatchSize)
+		if err != nil {
+			return err
+		}
+		names := map[string]string{}
+		for rows.Next() {
+			var id, name string
+			if err := rows.Scan(&id, &name); err != nil {
+				rows.Close()
+				return err
+			}
+			names[id] = name
+			last = id
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			break
+		}
+
+		for id, name := range names {
+			_, err := tx.ExecContext(ctx, "UPDATE nodes SET fold_name=? WHERE id=?", s.pathKey(name), id)
+			if e, ok := err.(*mysql.MySQLError); ok && e.Number == mysqlErrDupEntry {
+				return fmt.Errorf("node %s named %q has a sibling only differing in case, rename one of them first", id, name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		n += len(names)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE tree_generation SET case_insensitive=? WHERE id=1", s.paths.caseInsensitive)
+	if err != nil {
+		return err
+	}
+	if err := bumpTreeGeneration(ctx, tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rus.Infof("rekeyed the names of %d nodes for case_insensitive=%t", n, s.paths.caseInsensitive)
+	return nil
+}
+
+// treeWalk resolves p element by element and returns the ref of p
+// and of each of its ancestors but the root, from the shallowest.
+// Missing elements fail with gorm.RecordNotFound unless create is set,
+// in which case placeholders are created for them. In a case
+// insensitive namespace elements are matched by their folded name.
+func (s *server) treeWalk(ctx context.Context, p string, create bool) ([]treeRef, error) {
+
+	generation, err := s.treeGeneration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []treeRef{}
+	if p == "/" {
+		return refs, nil
+	}
+
+	parent := treeRef{id: "", path: "/"}
+	for _, name := range strings.Split(p[1:], "/") {
+		key := s.pathKey(path.Join(parent.path, name))
+		ref, ok := s.treeCache.get(key)
+		if !ok {
+			ref, err = s.treeLookup(ctx, parent, name, create)
+			if err != nil {
+				return nil, err
+			}
+			s.treeCache.add(generation, key, ref)
+		}
+		refs = append(refs, ref)
+		parent = ref
+	}
+	return refs, nil
+}
+
+// treeLookup returns the child name of parent, creating a
+// placeholder for it if missing and create is set.
+func (s *server) treeLookup(ctx context.Context, parent treeRef, name string, create bool) (treeRef, error) {
+
+	where, arg := "parent_id=? AND name=?", name
+	if s.paths.caseInsensitive {
+		where, arg = "parent_id=? AND fold_name=?", s.paths.fold(name)
+	}
+
+	for {
+		var id, stored string
+		err := s.db.DB().QueryRowContext(ctx, "SELECT id, name FROM nodes WHERE "+where+" LIMIT 1", parent.id, arg).Scan(&id, &stored)
+		if err == nil {
+			return treeRef{id: id, path: path.Join(parent.path, stored)}, nil
+		}
+		if err != sql.ErrNoRows {
+			return treeRef{}, err
+		}
+		if !create {
+			return treeRef{}, gorm.RecordNotFound
+		}
+
+		rawID, err := uuid.NewV4()
+		if err != nil {
+			return treeRef{}, err
+		}
+		// a concurrent request may create it first, found by the next lookup
+		_, err = s.db.DB().ExecContext(ctx, `INSERT IGNORE INTO nodes (id, parent_id, name, fold_name, placeholder)
+		VALUES (?,?,?,?,1)`, rawID.String(), parent.id, name, s.pathKey(name))
+		if err != nil {
+			return treeRef{}, err
+		}
+	}
+}
+
+func (s *server) treeGetNode(ctx context.Context, id string) (*node, error) {
+	n := &node{}
+	err := scanNode(s.db.DB().QueryRowContext(ctx, "SELECT "+nodeColumns+" FROM nodes WHERE id=?", id), n)
+	if err == sql.ErrNoRows {
+		return nil, gorm.RecordNotFound
+	}
+	return n, err
+}
+
+// treeGetByPath is getByPath in the tree layout.
+func (s *server) treeGetByPath(ctx context.Context, p string) (*record, error) {
+
+	refs, err := s.treeWalk(ctx, p, false)
+	if err != nil {
+		return &record{}, err
+	}
+	if len(refs) == 0 {
+		return &record{}, gorm.RecordNotFound
+	}
+	ref := refs[len(refs)-1]
+
+	n, err := s.treeGetNode(ctx, ref.id)
+	if err != nil {
+		return &record{}, err
+	}
+	if n.placeholder {
+		return &record{}, gorm.RecordNotFound
+	}
+	r := s.nodeRecord(n, ref.path)
+	return &r, nil
+}
+
+// treePut creates or updates the record of p, creating placeholders
+// for its missing ancestors. A new node gets id.
+func (s *server) treePut(ctx context.Context, id, p, checksum, etag string, mtime uint32) error {
+
+	if p == "/" {
+		return &pathError{p, "the root cannot have a record in the tree layout"}
+	}
+	parents, err := s.treeWalk(ctx, path.Dir(p), true)
+	if err != nil {
+		return err
+	}
+	parent := treeRef{id: "", path: "/"}
+	if len(parents) > 0 {
+		parent = parents[len(parents)-1]
+	}
+
+	name := path.Base(p)
+	_, err = s.db.DB().ExecContext(ctx, `INSERT INTO nodes (id, parent_id, name, fold_name, checksum, e_tag, m_time, placeholder)
+	VALUES (?,?,?,?,?,?,?,0)
+	ON DUPLICATE KEY UPDATE checksum=VALUES(checksum), e_tag=VALUES(e_tag), m_time=VALUES(m_time), placeholder=0`,
+		id, parent.id, name, s.pathKey(name), checksum, etag, mtime)
+	return err
+}
+
+// treeUpdate is update in the tree layout. Placeholders are updated
+// too, as they are the directories changes propagate through.
+func (s *server) treeUpdate(ctx context.Context, p, etag string, mtime uint32) (int64, error) {
+
+	refs, err := s.treeWalk(ctx, p, false)
+	if err == gorm.RecordNotFound || (err == nil && len(refs) == 0) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := s.db.DB().ExecContext(ctx, "UPDATE nodes SET e_tag=?, m_time=? WHERE id=? AND m_time < ?",
+		etag, mtime, refs[len(refs)-1].id, mtime)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// treeMove moves the node of src, and so its whole subtree, to dst
+// changing a single row. The move is rolled back if the path of any
+// descendant would exceed the limits under dst.
+func (s *server) treeMove(ctx context.Context, src, dst string) error {
+
+	srcRefs, err := s.treeWalk(ctx, src, false)
+	if err != nil {
+		return err
+	}
+	if len(srcRefs) == 0 {
+		return &pathError{src, "the root cannot be moved"}
+	}
+	if dst == srcRefs[len(srcRefs)-1].path {
+		return nil
+	}
+
+	parents, err := s.treeWalk(ctx, path.Dir(dst), true)
+	if err != nil {
+		return err
+	}
+	parentID := ""
+	if len(parents) > 0 {
+		parentID = parents[len(parents)-1].id
+	}
+
+	tx, err := s.db.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	name := path.Base(dst)
+	_, err = tx.ExecContext(ctx, "UPDATE nodes SET parent_id=?, name=?, fold_name=? WHERE id=?",
+		parentID, name, s.pathKey(name), srcRefs[len(srcRefs)-1].id)
+	if err != nil {
+		return err
+	}
+
+	// descendants may exceed the limits once moved under dst
+	srcPath := srcRefs[len(srcRefs)-1].path
+	err = visitNodes(ctx, tx, srcRefs[len(srcRefs)-1], func(n *node, p string) error {
+		_, err := canonicalPath(dst + strings.TrimPrefix(p, srcPath))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := bumpTreeGeneration(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// treeRemove removes the node of p and its subtree changed before ts,
+// as the path layout does. The nodes changed since, by Put calls made
+// during the removal, are kept with their ancestors so they can still
+// be reached.
+func (s *server) treeRemove(ctx context.Context, p string, ts int64) error {
+
+	refs, err := s.treeWalk(ctx, p, false)
+	if err == gorm.RecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	nodes := []*node{}
+	if len(refs) > 0 {
+		n, err := s.treeGetNode(ctx, refs[len(refs)-1].id)
+		if err == gorm.RecordNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, n)
+	}
+	err = s.treeVisit(ctx, refs, func(n *node, p string) error {
+		nodes = append(nodes, n)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	parents := map[string]string{}
+	for _, n := range nodes {
+		parents[n.id] = n.parentID
+	}
+	kept := map[string]bool{}
+	for _, n := range nodes {
+		if int64(n.mtime) < ts {
+			continue
+		}
+		for id, ok := n.id, true; ok && !kept[id]; id, ok = parents[id] {
+			kept[id] = true
+		}
+	}
+	ids := []interface{}{}
+	for _, n := range nodes {
+		if !kept[n.id] {
+			ids = append(ids, n.id)
+		}
+	}
+
+	tx, err := s.db.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the nodes changed since they were read are kept as well
+	if err := deleteNodes(ctx, tx, ids, ts); err != nil {
+		return err
+	}
+	if err := bumpTreeGeneration(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteNodes deletes the nodes of ids in batches. If before is not
+// zero only those changed before it are.
+func deleteNodes(ctx context.Context, tx *sql.Tx, ids []interface{}, before int64) error {
+	for i := 0; i < len(ids); i += treeBatchSize {
+		batch := ids[i:]
+		if len(batch) > treeBatchSize {
+			batch = batch[:treeBatchSize]
+		}
+		query := "DELETE FROM nodes WHERE id IN (" + placeholders(len(batch)) + ")"
+		if before != 0 {
+			query += " AND m_time < ?"
+			batch = append(batch[:len(batch):len(batch)], before)
+		}
+		if _, err := tx.ExecContext(ctx, query, batch...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeVisit calls f with every node under the last of refs, the
+// root if refs is empty, and its path, level by level. It stops at
+// the first error returned by f.
+func (s *server) treeVisit(ctx context.Context, refs []treeRef, f func(n *node, p string) error) error {
+
+	root := treeRef{id: "", path: "/"}
+	if len(refs) > 0 {
+		root = refs[len(refs)-1]
+	}
+	return visitNodes(ctx, s.db.DB(), root, f)
+}
+
+// visitNodes calls f with every node under root read through q,
+// as treeVisit does.
+func visitNodes(ctx context.Context, q queryer, root treeRef, f func(n *node, p string) error) error {
+
+	level := map[string]string{root.id: root.path}
+	for len(level) > 0 {
+		ids := []interface{}{}
+		for id := range level {
+			ids = append(ids, id)
+		}
+
+		next := map[string]string{}
+		for i := 0; i < len(ids); i += treeBatchSize {
+			batch := ids[i:]
+			if len(batch) > treeBatchSize {
+				batch = batch[:treeBatchSize]
+			}
+
+			rows, err := q.QueryContext(ctx, "SELECT "+nodeColumns+" FROM nodes WHERE parent_id IN ("+placeholders(len(batch))+")", batch...)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				n := &node{}
+				if err := scanNode(rows, n); err != nil {
+					rows.Close()
+					return err
+				}
+				p := path.Join(level[n.parentID], n.name)
+				if err := f(n, p); err != nil {
+					rows.Close()
+					return err
+				}
+				next[n.id] = p
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+		}
+		level = next
+	}
+	return nil
+}
+
+// treeGetDescendants is getDescendants in the tree layout. If children
+// is set only the records directly under p are returned.
+func (s *server) treeGetDescendants(ctx context.Context, p string, children bool) ([]record, error) {
+
+	refs, err := s.treeWalk(ctx, p, false)
+	if err == gorm.RecordNotFound {
+		return []record{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recs := []record{}
+	if children {
+		parentID, parentPath := "", "/"
+		if len(refs) > 0 {
+			parentID, parentPath = refs[len(refs)-1].id, refs[len(refs)-1].path
+		}
+		rows, err := s.db.DB().QueryContext(ctx, "SELECT "+nodeColumns+" FROM nodes WHERE parent_id=? AND placeholder=0 ORDER BY name", parentID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			n := &node{}
+			if err := scanNode(rows, n); err != nil {
+				return nil, err
+			}
+			recs = append(recs, s.nodeRecord(n, path.Join(parentPath, n.name)))
+		}
+		return recs, rows.Err()
+	}
+
+	err = s.treeVisit(ctx, refs, func(n *node, p string) error {
+		if !n.placeholder {
+			recs = append(recs, s.nodeRecord(n, p))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(recordsByPath(recs))
+	return recs, nil
+}
+
+// treeEachDescendant is eachDescendant in the tree layout.
+func (s *server) treeEachDescendant(ctx context.Context, p string, f func(r *record) error) error {
+
+	refs, err := s.treeWalk(ctx, p, false)
+	if err == gorm.RecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.treeVisit(ctx, refs, func(n *node, p string) error {
+		if n.placeholder {
+			return nil
+		}
+		r := s.nodeRecord(n, p)
+		return f(&r)
+	})
+}
+
+// treeGetHomes is getHomes in the tree layout: the nodes homeDepth
+// levels deep under prefix, or the home prefix is under.
+func (s *server) treeGetHomes(ctx context.Context, prefix string) ([]string, error) {
+
+	homes := []string{}
+	refs, err := s.treeWalk(ctx, prefix, false)
+	if err == gorm.RecordNotFound {
+		return homes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	homeDepth := s.getRuntime().homeDepth
+	if len(refs) >= homeDepth {
+		if homeDepth > 0 {
+			homes = append(homes, refs[homeDepth-1].path)
+		}
+		return homes, nil
+	}
+
+	level := []treeRef{{id: "", path: "/"}}
+	if len(refs) > 0 {
+		level = refs[len(refs)-1:]
+	}
+	for depth := len(refs); depth < homeDepth && len(level) > 0; depth++ {
+		next := []treeRef{}
+		for i := 0; i < len(level); i += treeBatchSize {
+			batch := level[i:]
+			if len(batch) > treeBatchSize {
+				batch = batch[:treeBatchSize]
+			}
+			ids := []interface{}{}
+			paths := map[string]string{}
+			for _, ref := range batch {
+				ids = append(ids, ref.id)
+				paths[ref.id] = ref.path
+			}
+
+			rows, err := s.db.DB().QueryContext(ctx, "SELECT id, parent_id, name FROM nodes WHERE parent_id IN ("+placeholders(len(ids))+")", ids...)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				var id, parentID, name string
+				if err := rows.Scan(&id, &parentID, &name); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				next = append(next, treeRef{id: id, path: path.Join(paths[parentID], name)})
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return nil, err
+			}
+		}
+		level = next
+	}
+
+	for _, ref := range level {
+		homes = append(homes, ref.path)
+	}
+	sort.Strings(homes)
+	return homes, nil
+}
+
+// treeCaseCollision is caseCollision in the tree layout: it returns a
+// node on the way to p whose name only differs in case from the one
+// in p, ignoring the nodes under the ignore subtree.
+func (s *server) treeCaseCollision(ctx context.Context, p, ignore string) (*record, error) {
+
+	refs, err := s.treeWalk(ctx, p, false)
+	if err != nil && err != gorm.RecordNotFound {
+		return nil, err
+	}
+	if err == gorm.RecordNotFound {
+		// the missing elements cannot collide but the ones found can
+		refs, err = s.treeWalkExisting(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	want := pathAndAncestors(p)
+	for i, ref := range refs {
+		if ignore != "" && (ref.path == ignore || isAncestor(ignore, ref.path)) {
+			continue
+		}
+		if ref.path != want[i] {
+			return &record{ID: ref.id, Path: ref.path, FoldPath: s.paths.fold(ref.path)}, nil
+		}
+	}
+	return nil, nil
+}
+
+// treeWalkExisting returns the refs of the longest ancestor of p
+// that exists, as treeWalk does.
+func (s *server) treeWalkExisting(ctx context.Context, p string) ([]treeRef, error) {
+	for a := path.Dir(p); ; a = path.Dir(a) {
+		refs, err := s.treeWalk(ctx, a, false)
+		if err != gorm.RecordNotFound {
+			return refs, err
+		}
+		if a == "/" {
+			return []treeRef{}, nil
+		}
+	}
+}
+
+type recordsByPath []record
+
+func (r recordsByPath) Len() int           { return len(r) }
+func (r recordsByPath) Less(i, j int) bool { return r[i].Path < r[j].Path }
+func (r recordsByPath) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
@@ -2,17 +2,23 @@ package main
 
 import (
 	"fmt"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 	"github.com/nu7hatch/gouuid"
 	"golang.org/x/net/context"
 	metadata "google.golang.org/grpc/metadata"
+	"net/url"
+	"strings"
 )
 
-// TODO(labkode) set collation for table and column to utf8. The default is swedish
+// record is a row of the records table, whose schema is defined by
+// the migrations. ID is the primary key and paths are unique by their
+// hash; the path hash and the parent path are generated by MySQL.
 type record struct {
 	ID       string
-	Path     string `sql:"unique_index:idx_path"`
+	Path     string
+	FoldPath string
 	Checksum string
 	ETag     string
 	MTime    uint32
@@ -22,19 +28,63 @@ func (r *record) String() string {
 	return fmt.Sprintf("id=%s path=%s sum=%s etag=%s mtime=%d",
 		r.ID, r.Path, r.Checksum, r.ETag, r.MTime)
 }
+
+// newPBRecord returns the protobuf message of r.
+func newPBRecord(r *record) *pb.Record {
+	rec := &pb.Record{}
+	rec.Id = r.ID
+	rec.Path = r.Path
+	rec.Etag = r.ETag
+	rec.Modified = r.MTime
+	rec.Checksum = r.Checksum
+	return rec
+}
+
 func newDB(driver, dsn string) (*gorm.DB, error) {
 
+	if driver == "mysql" {
+		dsn = mysqlDSN(dsn)
+	}
+
 	db, err := gorm.Open(driver, dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	db.AutoMigrate(&record{})
-
 	return &db, nil
 }
+
+// mysqlDSN adds to dsn the session settings every connection needs.
+func mysqlDSN(dsn string) string {
+	// the connection must use utf8mb4 like the table does
+	// or 4 byte characters are mangled on the wire.
+	dsn = addDSNParam(dsn, "charset", "utf8mb4")
+	// without a strict mode values too long for their column are
+	// truncated with a warning instead of failing the statement
+	return addDSNParam(dsn, "sql_mode", "CONCAT_WS(',', NULLIF(@@sql_mode, ''), 'STRICT_ALL_TABLES')")
+}
+
+// addDSNParam adds the key parameter to dsn unless it is already set.
+func addDSNParam(dsn, key, value string) string {
+	if strings.Contains(dsn, key+"=") {
+		return dsn
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + key + "=" + url.QueryEscape(value)
+	}
+	return dsn + "?" + key + "=" + url.QueryEscape(value)
+}
+
+// newGRPCTraceContext returns a context carrying the trace ID.
+// The rest of the metadata, like the authorization header, is kept.
 func newGRPCTraceContext(ctx context.Context, trace string) context.Context {
-	md := metadata.Pairs("trace", trace)
+	md, ok := metadata.FromContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	md["trace"] = []string{trace}
 	ctx = metadata.NewContext(ctx, md)
 	return ctx
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	metadata "google.golang.org/grpc/metadata"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	davNS = "DAV:"
+	ocNS  = "http://owncloud.org/ns"
+)
+
+// davProps are the properties served by PROPFIND, whose values are
+// returned as inner XML. The records do not know whether a path is a
+// collection, so resourcetype is left to the DAV frontend.
+var davProps = []struct {
+	name  xml.Name
+	value func(r *pb.Record) string
+}{
+	{xml.Name{Space: davNS, Local: "getetag"}, func(r *pb.Record) string {
+		return escapeXML(`"` + r.Etag + `"`)
+	}},
+	{xml.Name{Space: davNS, Local: "getlastmodified"}, func(r *pb.Record) string {
+		return time.Unix(int64(r.Modified), 0).UTC().Format(http.TimeFormat)
+	}},
+	{xml.Name{Space: ocNS, Local: "fileid"}, func(r *pb.Record) string {
+		return escapeXML(r.Id)
+	}},
+	{xml.Name{Space: ocNS, Local: "checksums"}, func(r *pb.Record) string {
+		if r.Checksum == "" {
+			return ""
+		}
+		return "<oc:checksum>" + escapeXML(r.Checksum) + "</oc:checksum>"
+	}},
+}
+
+// propfind is the body of a PROPFIND request. An empty body is an allprop.
+type propfind struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	Allprop  *struct{} `xml:"DAV: allprop"`
+	Propname *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Props []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// dav answers PROPFIND requests at Depth 0 and 1 under prefix from
+// the records, authenticated like the gRPC API.
+func (g *gateway) dav(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Set("DAV", "1")
+			w.Header().Set("Allow", "OPTIONS, PROPFIND")
+			return
+		case "PROPFIND":
+		default:
+			w.Header().Set("Allow", "OPTIONS, PROPFIND")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		// infinite depth would walk whole homes, Depth 1 is assumed
+		// when missing as most clients do not send it
+		depth := r.Header.Get("Depth")
+		if depth == "" {
+			depth = "1"
+		}
+		if depth != "0" && depth != "1" {
+			writeDAVError(w, http.StatusForbidden, "propfind-finite-depth")
+			return
+		}
+
+		pf := &propfind{}
+		body := http.MaxBytesReader(w, r.Body, maxGatewayBody)
+		if err := xml.NewDecoder(body).Decode(pf); err != nil && err != io.EOF {
+			http.Error(w, "invalid PROPFIND body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, trailer := g.context(w, r)
+		p := "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+		rec, err := g.srv.Get(ctx, &pb.GetReq{Path: p})
+		if err != nil {
+			writeDAVStatus(w, err, *trailer)
+			return
+		}
+		recs := []*pb.Record{rec}
+
+		if depth == "1" {
+			res, err := g.srv.List(ctx, &pb.ListReq{Path: rec.Path})
+			if err != nil {
+				writeDAVStatus(w, err, *trailer)
+				return
+			}
+			recs = append(recs, res.GetRecords()...)
+		}
+
+		buf := &bytes.Buffer{}
+		buf.WriteString(xml.Header)
+		buf.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:oc="` + ocNS + `">`)
+		for _, rec := range recs {
+			writeDAVResponse(buf, prefix, rec, pf)
+		}
+		buf.WriteString(`</d:multistatus>`)
+
+		w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+		w.WriteHeader(207)
+		w.Write(buf.Bytes())
+	}
+}
+
+// writeDAVResponse writes the response element of rec with the
+// properties asked for in pf.
+func writeDAVResponse(buf *bytes.Buffer, prefix string, rec *pb.Record, pf *propfind) {
+	href := (&url.URL{Path: strings.TrimSuffix(prefix, "/") + rec.Path}).EscapedPath()
+	buf.WriteString("<d:response><d:href>" + escapeXML(href) + "</d:href>")
+
+	found := &bytes.Buffer{}
+	missing := &bytes.Buffer{}
+	switch {
+	case pf.Prop != nil:
+		for _, asked := range pf.Prop.Props {
+			known := false
+			for _, prop := range davProps {
+				if prop.name == asked.XMLName {
+					writeDAVProp(found, prop.name, prop.value(rec))
+					known = true
+					break
+				}
+			}
+			if !known {
+				writeDAVProp(missing, asked.XMLName, "")
+			}
+		}
+	case pf.Propname != nil:
+		for _, prop := range davProps {
+			writeDAVProp(found, prop.name, "")
+		}
+	default:
+		for _, prop := range davProps {
+			writeDAVProp(found, prop.name, prop.value(rec))
+		}
+	}
+
+	if found.Len() > 0 {
+		buf.WriteString("<d:propstat><d:prop>" + found.String() + "</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>")
+	}
+	if missing.Len() > 0 {
+		buf.WriteString("<d:propstat><d:prop>" + missing.String() + "</d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat>")
+	}
+	buf.WriteString("</d:response>")
+}
+
+// writeDAVProp writes the property name with the inner XML value.
+// Properties of other namespaces, which are only reported as missing,
+// declare their own.
+func writeDAVProp(buf *bytes.Buffer, name xml.Name, value string) {
+	var tag, ns string
+	switch name.Space {
+	case davNS:
+		tag = "d:" + name.Local
+	case ocNS:
+		tag = "oc:" + name.Local
+	default:
+		tag = "x:" + name.Local
+		ns = ` xmlns:x="` + escapeXML(name.Space) + `"`
+	}
+
+	if value == "" {
+		buf.WriteString("<" + tag + ns + "/>")
+		return
+	}
+	buf.WriteString("<" + tag + ns + ">" + value + "</" + tag + ">")
+}
+
+func escapeXML(s string) string {
+	buf := &bytes.Buffer{}
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// writeDAVStatus writes the HTTP status of a failed RPC.
+// DAV clients do not understand the JSON errors of the gateway.
+func writeDAVStatus(w http.ResponseWriter, err error, trailer metadata.MD) {
+	code := grpc.Code(err)
+	if v := trailer[retryAfterKey]; len(v) > 0 {
+		w.Header().Set("Retry-After", v[0])
+	}
+	if code == codes.Unauthenticated {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	status := httpStatus(code)
+	http.Error(w, http.StatusText(status), status)
+}
+
+// writeDAVError writes a DAV error with the precondition element.
+func writeDAVError(w http.ResponseWriter, status int, precondition string) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `%s<d:error xmlns:d="DAV:"><d:%s/></d:error>`, xml.Header, precondition)
+}
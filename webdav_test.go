@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/xml"
+	pb "github.com/clawio/service-localfs-prop/proto/propagator"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	metadata "google.golang.org/grpc/metadata"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// stubProps serves Get and List from records by path to callers
+// sending an authorization header.
+type stubProps struct {
+	records map[string]*pb.Record
+}
+
+func (s *stubProps) authorized(ctx context.Context) error {
+	md, ok := metadata.FromContext(ctx)
+	if !ok || len(md[authorizationKey]) == 0 {
+		return grpc.Errorf(codes.Unauthenticated, "no token")
+	}
+	return nil
+}
+
+func (s *stubProps) Get(ctx context.Context, req *pb.GetReq) (*pb.Record, error) {
+	if err := s.authorized(ctx); err != nil {
+		return nil, err
+	}
+	rec, ok := s.records[req.Path]
+	if !ok {
+		return nil, newGRPCError(ctx, codes.NotFound, reasonNotFound, req.Path, "record not found")
+	}
+	return rec, nil
+}
+
+func (s *stubProps) List(ctx context.Context, req *pb.ListReq) (*pb.Records, error) {
+	if err := s.authorized(ctx); err != nil {
+		return nil, err
+	}
+	res := &pb.Records{}
+	for p, rec := range s.records {
+		if path.Dir(p) == req.Path && p != req.Path {
+			res.Records = append(res.Records, rec)
+		}
+	}
+	sort.Slice(res.Records, func(i, j int) bool { return res.Records[i].Path < res.Records[j].Path })
+	return res, nil
+}
+
+func (s *stubProps) Put(ctx context.Context, req *pb.PutReq) (*pb.Void, error) {
+	return nil, grpc.Errorf(codes.Unimplemented, "put")
+}
+
+func (s *stubProps) Mv(ctx context.Context, req *pb.MvReq) (*pb.Void, error) {
+	return nil, grpc.Errorf(codes.Unimplemented, "mv")
+}
+
+func (s *stubProps) Rm(ctx context.Context, req *pb.RmReq) (*pb.Void, error) {
+	return nil, grpc.Errorf(codes.Unimplemented, "rm")
+}
+
+// multistatus is the body of a 207 response.
+type multistatus struct {
+	XMLName   xml.Name `xml:"DAV: multistatus"`
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Prop struct {
+				Props []struct {
+					XMLName xml.Name
+					Inner   string `xml:",innerxml"`
+				} `xml:",any"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// sendPROPFIND sends a PROPFIND of p with depth, if not empty, and body
+// to a gateway of a stubProps answering under /dav.
+func sendPROPFIND(t *testing.T, p, depth, body string, authorized bool) *httptest.ResponseRecorder {
+	home := "/local/users/d/demo"
+	srv := &stubProps{records: map[string]*pb.Record{
+		home:             {Id: "1", Path: home, Etag: "e1", Modified: 1500000000},
+		home + "/a b":    {Id: "2", Path: home + "/a b", Etag: "e2", Modified: 1500000000, Checksum: "md5:2"},
+		home + "/<c>":    {Id: "3", Path: home + "/<c>", Etag: "e3", Modified: 1500000000},
+		home + "/a b/d":  {Id: "4", Path: home + "/a b/d", Etag: "e4", Modified: 1500000000},
+		"/local/users/e": {Id: "5", Path: "/local/users/e", Etag: "e5", Modified: 1500000000},
+	}}
+
+	r := httptest.NewRequest("PROPFIND", (&url.URL{Path: "/dav" + p}).EscapedPath(), strings.NewReader(body))
+	if depth != "" {
+		r.Header.Set("Depth", depth)
+	}
+	if authorized {
+		r.Header.Set("Authorization", "Bearer token")
+	}
+	w := httptest.NewRecorder()
+	newGateway(srv, "/dav/").ServeHTTP(w, r)
+	return w
+}
+
+func parseMultistatus(t *testing.T, w *httptest.ResponseRecorder) *multistatus {
+	if w.Code != 207 {
+		t.Fatalf("status %d, want 207: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/xml") {
+		t.Fatalf("content type %q", ct)
+	}
+	ms := &multistatus{}
+	if err := xml.Unmarshal(w.Body.Bytes(), ms); err != nil {
+		t.Fatalf("%s: %s", err, w.Body)
+	}
+	return ms
+}
+
+func TestPROPFINDDepth(t *testing.T) {
+	home := "/local/users/d/demo"
+	tests := []struct {
+		depth string
+		hrefs []string
+	}{
+		{"0", []string{"/dav" + home}},
+		{"1", []string{"/dav" + home, "/dav" + home + "/%3Cc%3E", "/dav" + home + "/a%20b"}},
+		// the default of most clients
+		{"", []string{"/dav" + home, "/dav" + home + "/%3Cc%3E", "/dav" + home + "/a%20b"}},
+	}
+	for _, tt := range tests {
+		ms := parseMultistatus(t, sendPROPFIND(t, home, tt.depth, "", true))
+		hrefs := []string{}
+		for _, r := range ms.Responses {
+			hrefs = append(hrefs, r.Href)
+		}
+		if strings.Join(hrefs, " ") != strings.Join(tt.hrefs, " ") {
+			t.Errorf("depth %q: hrefs %v, want %v", tt.depth, hrefs, tt.hrefs)
+		}
+	}
+}
+
+func TestPROPFINDInfiniteDepth(t *testing.T) {
+	w := sendPROPFIND(t, "/local/users/d/demo", "infinity", "", true)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status %d, want 403", w.Code)
+	}
+	e := struct {
+		XMLName xml.Name  `xml:"DAV: error"`
+		Finite  *struct{} `xml:"DAV: propfind-finite-depth"`
+	}{}
+	if err := xml.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Finite == nil {
+		t.Errorf("body without propfind-finite-depth (%v): %s", err, w.Body)
+	}
+}
+
+func TestPROPFINDProps(t *testing.T) {
+	p := "/local/users/d/demo/a b"
+
+	// allprop
+	ms := parseMultistatus(t, sendPROPFIND(t, p, "0", "", true))
+	if len(ms.Responses) != 1 || len(ms.Responses[0].Propstats) != 1 {
+		t.Fatalf("allprop: %+v", ms)
+	}
+	ps := ms.Responses[0].Propstats[0]
+	if ps.Status != "HTTP/1.1 200 OK" {
+		t.Errorf("allprop status %q", ps.Status)
+	}
+	got := map[string]string{}
+	for _, prop := range ps.Prop.Props {
+		got[prop.XMLName.Space+" "+prop.XMLName.Local] = prop.Inner
+	}
+	want := map[string]string{
+		davNS + " getetag":         "&#34;e2&#34;",
+		davNS + " getlastmodified": "Fri, 14 Jul 2017 02:40:00 GMT",
+		ocNS + " fileid":           "2",
+		ocNS + " checksums":        "<oc:checksum>md5:2</oc:checksum>",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("allprop %s = %q, want %q", k, got[k], v)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("allprop returned %v", got)
+	}
+
+	// known and unknown properties in separate propstats
+	body := `<?xml version="1.0"?><d:propfind xmlns:d="DAV:" xmlns:x="urn:x"><d:prop><d:getetag/><d:resourcetype/><x:color/></d:prop></d:propfind>`
+	ms = parseMultistatus(t, sendPROPFIND(t, p, "0", body, true))
+	statuses := map[string][]string{}
+	for _, ps := range ms.Responses[0].Propstats {
+		for _, prop := range ps.Prop.Props {
+			statuses[ps.Status] = append(statuses[ps.Status], prop.XMLName.Space+" "+prop.XMLName.Local)
+		}
+	}
+	if s := strings.Join(statuses["HTTP/1.1 200 OK"], ","); s != davNS+" getetag" {
+		t.Errorf("found properties %q", s)
+	}
+	if s := strings.Join(statuses["HTTP/1.1 404 Not Found"], ","); s != davNS+" resourcetype,urn:x color" {
+		t.Errorf("missing properties %q", s)
+	}
+
+	// propname lists the names without values
+	body = `<?xml version="1.0"?><d:propfind xmlns:d="DAV:"><d:propname/></d:propfind>`
+	ms = parseMultistatus(t, sendPROPFIND(t, p, "0", body, true))
+	for _, prop := range ms.Responses[0].Propstats[0].Prop.Props {
+		if prop.Inner != "" {
+			t.Errorf("propname %s with value %q", prop.XMLName.Local, prop.Inner)
+		}
+	}
+
+	w := sendPROPFIND(t, p, "0", "<d:propfind", true)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid body: status %d, want 400", w.Code)
+	}
+}
+
+func TestPROPFINDErrors(t *testing.T) {
+	w := sendPROPFIND(t, "/local/users/d/missing", "0", "", true)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing record: status %d, want 404", w.Code)
+	}
+
+	w = sendPROPFIND(t, "/local/users/d/demo", "0", "", false)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("no token: status %d with challenge %q, want 401", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	for method, status := range map[string]int{"OPTIONS": http.StatusOK, "GET": http.StatusMethodNotAllowed} {
+		r := httptest.NewRequest(method, "/dav/local", nil)
+		w := httptest.NewRecorder()
+		newGateway(&stubProps{}, "/dav").ServeHTTP(w, r)
+		if w.Code != status || w.Header().Get("Allow") != "OPTIONS, PROPFIND" {
+			t.Errorf("%s: status %d, Allow %q", method, w.Code, w.Header().Get("Allow"))
+		}
+	}
+}